@@ -0,0 +1,320 @@
+/**
+ * acl.go - client allow/deny lists and inner traffic rules
+ */
+
+package acl
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"../config"
+	"../utils/packet"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	ACTION_ALLOW = "allow"
+	ACTION_DROP  = "drop"
+
+	/* Verdicts of fragmented packets are kept for ip reassembly timeout */
+	FRAGMENT_TIMEOUT = 30 * time.Second
+	MAX_FRAGMENTS    = 4096
+)
+
+/**
+ * Fragmented packet, identified by addresses, protocol and ip id
+ */
+type fragmentKey struct {
+	src      [4]byte
+	dst      [4]byte
+	protocol int
+	id       int
+}
+
+/**
+ * Verdict of first fragment, applied to the rest of them
+ */
+type fragment struct {
+	allow   bool
+	expires time.Time
+}
+
+/**
+ * Compiled inner traffic rule
+ */
+type rule struct {
+	name    string
+	matcher packet.Matcher
+	allow   bool
+
+	hits uint64
+}
+
+/**
+ * Access control lists
+ */
+type Acl struct {
+
+	/* Outer client addresses */
+	clientsAllow []*net.IPNet
+	clientsDeny  []*net.IPNet
+
+	/* Inner traffic rules, first match wins */
+	rules        []*rule
+	defaultAllow bool
+
+	/* Verdicts of first fragments, nil if no rule matches ports */
+	fragmentsLock sync.Mutex
+	fragments     map[fragmentKey]fragment
+
+	clientsDenied uint64
+	defaultHits   uint64
+}
+
+/**
+ * Acl counters
+ */
+type Stats struct {
+	ClientsDenied uint64            `json:"clients_denied"`
+	DefaultHits   uint64            `json:"default_hits"`
+	RuleHits      map[string]uint64 `json:"rule_hits"`
+}
+
+/**
+ * Creates acl from configuration
+ */
+func New(cfg config.AclConfig) (*Acl, error) {
+
+	acl := &Acl{
+		defaultAllow: true,
+	}
+
+	var err error
+
+	if acl.clientsAllow, err = parseNets(cfg.ClientsAllow); err != nil {
+		return nil, err
+	}
+	if acl.clientsDeny, err = parseNets(cfg.ClientsDeny); err != nil {
+		return nil, err
+	}
+
+	if acl.defaultAllow, err = parseAction(cfg.Default); err != nil {
+		return nil, err
+	}
+
+	for i, r := range cfg.Rules {
+		rule := &rule{
+			name: r.Name,
+			matcher: packet.Matcher{
+				Protocol:    -1,
+				Ports:       packet.IntSet(r.Ports),
+				DstPortOnly: true,
+			},
+		}
+		if rule.name == "" {
+			rule.name = "rule" + strconv.Itoa(i)
+		}
+		if rule.allow, err = parseAction(r.Action); err != nil {
+			return nil, err
+		}
+		if r.Src != "" {
+			if rule.matcher.Src, err = parseNet(r.Src); err != nil {
+				return nil, err
+			}
+		}
+		if r.Dst != "" {
+			if rule.matcher.Dst, err = parseNet(r.Dst); err != nil {
+				return nil, err
+			}
+		}
+		if r.Protocol != "" {
+			if rule.matcher.Protocol = packet.Protocol(r.Protocol); rule.matcher.Protocol == -1 {
+				return nil, errors.New("Unknown protocol " + r.Protocol)
+			}
+		}
+		if rule.matcher.Ports != nil {
+			acl.fragments = make(map[fragmentKey]fragment)
+		}
+		acl.rules = append(acl.rules, rule)
+	}
+
+	return acl, nil
+}
+
+/**
+ * Check if outer client address is allowed
+ */
+func (this *Acl) AllowClient(ip net.IP) bool {
+
+	if contains(this.clientsDeny, ip) ||
+		(len(this.clientsAllow) > 0 && !contains(this.clientsAllow, ip)) {
+		atomic.AddUint64(&this.clientsDenied, 1)
+		return false
+	}
+
+	return true
+}
+
+/**
+ * Check if inner packet is allowed.
+ * Ports are only known in first fragment, so its verdict is
+ * remembered and applied to other fragments of same packet
+ */
+func (this *Acl) AllowPacket(header *ipv4.Header, buf []byte) bool {
+
+	if this.fragments == nil {
+		return this.check(header, buf)
+	}
+
+	if header.FragOff > 0 {
+		if allow, ok := this.fragmentVerdict(header); ok {
+			return allow
+		}
+		return this.check(header, buf)
+	}
+
+	allow := this.check(header, buf)
+	if header.Flags&ipv4.MoreFragments != 0 {
+		this.rememberFragment(header, allow)
+	}
+	return allow
+}
+
+/**
+ * Match packet against rules
+ */
+func (this *Acl) check(header *ipv4.Header, buf []byte) bool {
+
+	for _, r := range this.rules {
+		if r.match(header, buf) {
+			atomic.AddUint64(&r.hits, 1)
+			return r.allow
+		}
+	}
+
+	atomic.AddUint64(&this.defaultHits, 1)
+	return this.defaultAllow
+}
+
+func newFragmentKey(header *ipv4.Header) fragmentKey {
+	key := fragmentKey{protocol: header.Protocol, id: header.ID}
+	copy(key.src[:], header.Src.To4())
+	copy(key.dst[:], header.Dst.To4())
+	return key
+}
+
+/**
+ * Get verdict of first fragment of packet if it was seen
+ */
+func (this *Acl) fragmentVerdict(header *ipv4.Header) (bool, bool) {
+	key := newFragmentKey(header)
+
+	this.fragmentsLock.Lock()
+	defer this.fragmentsLock.Unlock()
+
+	f, ok := this.fragments[key]
+	if !ok || time.Now().After(f.expires) {
+		return false, false
+	}
+	return f.allow, true
+}
+
+func (this *Acl) rememberFragment(header *ipv4.Header, allow bool) {
+	key := newFragmentKey(header)
+	now := time.Now()
+
+	this.fragmentsLock.Lock()
+	defer this.fragmentsLock.Unlock()
+
+	if len(this.fragments) >= MAX_FRAGMENTS {
+		for k, f := range this.fragments {
+			if now.After(f.expires) {
+				delete(this.fragments, k)
+			}
+		}
+		// when full, other fragments fall back to matching without ports
+		if len(this.fragments) >= MAX_FRAGMENTS {
+			return
+		}
+	}
+
+	this.fragments[key] = fragment{allow: allow, expires: now.Add(FRAGMENT_TIMEOUT)}
+}
+
+/**
+ * Get acl counters
+ */
+func (this *Acl) Stats() Stats {
+	stats := Stats{
+		ClientsDenied: atomic.LoadUint64(&this.clientsDenied),
+		DefaultHits:   atomic.LoadUint64(&this.defaultHits),
+		RuleHits:      make(map[string]uint64),
+	}
+	for _, r := range this.rules {
+		stats.RuleHits[r.name] = atomic.LoadUint64(&r.hits)
+	}
+	return stats
+}
+
+/**
+ * Packets with unknown ports match drop rules, so fragments can't bypass them
+ */
+func (r *rule) match(header *ipv4.Header, buf []byte) bool {
+	return r.matcher.Match(header, buf, !r.allow)
+}
+
+func parseAction(action string) (bool, error) {
+	switch strings.ToLower(action) {
+	case "", ACTION_ALLOW:
+		return true, nil
+	case ACTION_DROP, "deny":
+		return false, nil
+	default:
+		return false, errors.New("Unknown acl action " + action)
+	}
+}
+
+/**
+ * Parse CIDR or single address
+ */
+func parseNet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New("Bad address " + s)
+		}
+		if ip.To4() != nil {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+func parseNets(list []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, s := range list {
+		n, err := parseNet(s)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, n)
+	}
+	return result, nil
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,205 @@
+package acl
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"../config"
+	"../utils/packet"
+	"golang.org/x/net/ipv4"
+)
+
+/**
+ * Inner packet description
+ */
+type testPacket struct {
+	src      string
+	dst      string
+	protocol int
+	port     int
+	id       int
+	offset   int
+	more     bool
+}
+
+/**
+ * Marshal and parse packet as server does
+ */
+func (p testPacket) build(t *testing.T) (*ipv4.Header, []byte) {
+	h := &ipv4.Header{
+		Version:  4,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + 8,
+		ID:       p.id,
+		FragOff:  p.offset,
+		TTL:      64,
+		Protocol: p.protocol,
+		Src:      net.ParseIP(p.src),
+		Dst:      net.ParseIP(p.dst),
+	}
+	if p.more {
+		h.Flags = ipv4.MoreFragments
+	}
+	buf, err := h.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint16(payload[0:2], 40000)
+	binary.BigEndian.PutUint16(payload[2:4], uint16(p.port))
+	buf = append(buf, payload...)
+
+	header, err := ipv4.ParseHeader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header, buf
+}
+
+func newTestAcl(t *testing.T, cfg config.AclConfig) *Acl {
+	a, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestRules(t *testing.T) {
+	a := newTestAcl(t, config.AclConfig{
+		Default: "drop",
+		Rules: []config.AclRule{
+			{Name: "ssh", Protocol: "tcp", Ports: []int{22}, Src: "10.0.0.0/8", Action: "drop"},
+			{Name: "web", Protocol: "tcp", Ports: []int{80, 443}},
+			{Name: "dns", Protocol: "udp", Dst: "10.0.0.53", Ports: []int{53}},
+			{Name: "icmp", Protocol: "icmp"},
+		},
+	})
+
+	cases := []struct {
+		name   string
+		packet testPacket
+		allow  bool
+		rule   string
+	}{
+		{"web", testPacket{src: "192.168.0.1", dst: "10.0.0.1", protocol: packet.PROTO_TCP, port: 443}, true, "web"},
+		{"ssh from inside", testPacket{src: "10.1.0.1", dst: "10.0.0.1", protocol: packet.PROTO_TCP, port: 22}, false, "ssh"},
+		{"ssh from outside", testPacket{src: "192.168.0.1", dst: "10.0.0.1", protocol: packet.PROTO_TCP, port: 22}, false, ""},
+		{"dns", testPacket{src: "192.168.0.1", dst: "10.0.0.53", protocol: packet.PROTO_UDP, port: 53}, true, "dns"},
+		{"dns other server", testPacket{src: "192.168.0.1", dst: "10.0.0.54", protocol: packet.PROTO_UDP, port: 53}, false, ""},
+		{"udp to web port", testPacket{src: "192.168.0.1", dst: "10.0.0.1", protocol: packet.PROTO_UDP, port: 80}, false, ""},
+		{"icmp", testPacket{src: "192.168.0.1", dst: "10.0.0.1", protocol: packet.PROTO_ICMP}, true, "icmp"},
+	}
+
+	for _, c := range cases {
+		before := a.Stats()
+		header, buf := c.packet.build(t)
+		if allow := a.AllowPacket(header, buf); allow != c.allow {
+			t.Errorf("%s: allow %v, expected %v", c.name, allow, c.allow)
+		}
+		after := a.Stats()
+		if c.rule == "" {
+			if after.DefaultHits != before.DefaultHits+1 {
+				t.Errorf("%s: default was not hit", c.name)
+			}
+		} else if after.RuleHits[c.rule] != before.RuleHits[c.rule]+1 {
+			t.Errorf("%s: rule %s was not hit", c.name, c.rule)
+		}
+	}
+}
+
+func TestFragments(t *testing.T) {
+	a := newTestAcl(t, config.AclConfig{
+		Default: "drop",
+		Rules: []config.AclRule{
+			{Name: "ssh", Protocol: "tcp", Ports: []int{22}, Action: "drop"},
+			{Name: "web", Protocol: "tcp", Ports: []int{80}},
+		},
+	})
+
+	web := testPacket{src: "192.168.0.1", dst: "10.0.0.1", protocol: packet.PROTO_TCP, port: 80, id: 1}
+	ssh := testPacket{src: "192.168.0.1", dst: "10.0.0.1", protocol: packet.PROTO_TCP, port: 22, id: 2}
+
+	check := func(name string, p testPacket, expected bool) {
+		header, buf := p.build(t)
+		if allow := a.AllowPacket(header, buf); allow != expected {
+			t.Errorf("%s: allow %v, expected %v", name, allow, expected)
+		}
+	}
+
+	// later fragments follow verdict of first one
+	first, middle, last := web, web, web
+	first.more = true
+	middle.offset, middle.more = 1, true
+	last.offset = 2
+	check("web first fragment", first, true)
+	check("web middle fragment", middle, true)
+	check("web last fragment", last, true)
+
+	first, last = ssh, ssh
+	first.more = true
+	last.offset = 1
+	check("ssh first fragment", first, false)
+	check("ssh last fragment", last, false)
+
+	// fragment without first one hits drop rule
+	orphan := web
+	orphan.id, orphan.offset = 3, 1
+	check("fragment without first", orphan, false)
+
+	// same id from other source is other packet
+	other := web
+	other.src, other.offset = "192.168.0.2", 1
+	check("fragment of other source", other, false)
+}
+
+func TestFragmentsWithoutPortRules(t *testing.T) {
+	a := newTestAcl(t, config.AclConfig{
+		Rules: []config.AclRule{
+			{Protocol: "udp", Action: "drop"},
+		},
+	})
+	if a.fragments != nil {
+		t.Fatal("fragments are tracked without port rules")
+	}
+
+	header, buf := testPacket{src: "192.168.0.1", dst: "10.0.0.1", protocol: packet.PROTO_TCP, port: 80, offset: 1}.build(t)
+	if !a.AllowPacket(header, buf) {
+		t.Fatal("tcp fragment was dropped")
+	}
+}
+
+func TestAllowClient(t *testing.T) {
+	a := newTestAcl(t, config.AclConfig{
+		ClientsAllow: []string{"192.0.2.0/24"},
+		ClientsDeny:  []string{"192.0.2.66"},
+	})
+
+	cases := map[string]bool{
+		"192.0.2.1":    true,
+		"192.0.2.66":   false,
+		"198.51.100.1": false,
+	}
+	for ip, expected := range cases {
+		if a.AllowClient(net.ParseIP(ip)) != expected {
+			t.Errorf("client %s: expected %v", ip, expected)
+		}
+	}
+	if a.Stats().ClientsDenied != 2 {
+		t.Fatalf("clients denied %d", a.Stats().ClientsDenied)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	bad := []config.AclConfig{
+		{Default: "reject"},
+		{ClientsAllow: []string{"300.0.0.1"}},
+		{Rules: []config.AclRule{{Protocol: "sctp"}}},
+		{Rules: []config.AclRule{{Src: "10.0.0.0/33"}}},
+	}
+	for _, cfg := range bad {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("config %+v is accepted", cfg)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+/**
+ * bonding.go - bonding balance impl
+ */
+
+package balance
+
+import (
+	"errors"
+
+	"../core"
+)
+
+/**
+ * Bonding balancer
+ * Spreads packets across all backends proportionally
+ * to their weights (capacity)
+ */
+type BondingBalancer struct {
+
+	/* Current weights of backends by target */
+	current map[core.Target]int
+}
+
+/**
+ * Elect backend using smooth weighted roundrobin strategy
+ */
+func (b *BondingBalancer) Elect(context core.Context, backends []*core.Backend) (*core.Backend, error) {
+
+	if len(backends) == 0 {
+		return nil, errors.New("Can't elect backend, Backends empty")
+	}
+
+	if b.current == nil {
+		b.current = make(map[core.Target]int)
+	}
+
+	var best *core.Backend
+	total := 0
+
+	for _, backend := range backends {
+		weight := backend.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		total += weight
+		b.current[backend.Target] += weight
+		if best == nil || b.current[backend.Target] > b.current[best.Target] {
+			best = backend
+		}
+	}
+
+	b.current[best.Target] -= total
+
+	return best, nil
+}
@@ -22,6 +22,7 @@ var typeRegistry = make(map[string]reflect.Type)
 func init() {
 	typeRegistry["roundrobin"] = reflect.TypeOf(RoundrobinBalancer{})
 	typeRegistry["iphash"] = reflect.TypeOf(IphashBalancer{})
+	typeRegistry["bonding"] = reflect.TypeOf(BondingBalancer{})
 }
 
 /**
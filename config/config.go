@@ -8,8 +8,123 @@ type Config struct {
 type Server struct {
 	Bind	string			`toml:"bind" json:"bind"`
 	Balance	string			`toml:"balance" json:"balance"`
+	MssClamp bool			`toml:"mss_clamp" json:"mss_clamp"`
+	Encapsulation bool		`toml:"encapsulation" json:"encapsulation"`
+	Bonding *BondingConfig		`toml:"bonding" json:"bonding"`
+	Duplication *DuplicationConfig	`toml:"duplication" json:"duplication"`
+	Fec *FecConfig			`toml:"fec" json:"fec"`
+	Crypto *CryptoConfig		`toml:"crypto" json:"crypto"`
+	Keys map[string]*CryptoConfig	`toml:"keys" json:"keys"`
+	Noise *NoiseConfig		`toml:"noise" json:"noise"`
+	NewSessionsRate float64		`toml:"new_sessions_rate" json:"new_sessions_rate"`
+	NewSessionsBurst float64	`toml:"new_sessions_burst" json:"new_sessions_burst"`
+	Cookie *CookieConfig		`toml:"cookie" json:"cookie"`
+	Acl *AclConfig			`toml:"acl" json:"acl"`
+	Shaping *ShapingConfig		`toml:"shaping" json:"shaping"`
+	Qos *QosConfig			`toml:"qos" json:"qos"`
 	Discovery *DiscoveryConfig	`toml:"discovery" json:"discovery"`
+	Discoveries []DiscoveryConfig	`toml:"discoveries" json:"discoveries"`
 	Healthcheck *HealthcheckConfig	`toml:"healthcheck" json:"healthcheck"`
+	BackendSelector string		`toml:"backend_selector" json:"backend_selector"`
+	Routes []RouteConfig		`toml:"routes" json:"routes"`
+	StatsBind string		`toml:"stats_bind" json:"stats_bind"`
+}
+
+type BondingConfig struct {
+	ReorderWindow int		`toml:"reorder_window" json:"reorder_window"`
+	ReorderTimeout string		`toml:"reorder_timeout" json:"reorder_timeout"`
+}
+
+type DuplicationConfig struct {
+	Copies int			`toml:"copies" json:"copies"`
+	DedupWindow int			`toml:"dedup_window" json:"dedup_window"`
+	Rules []DuplicationRule		`toml:"rules" json:"rules"`
+}
+
+type DuplicationRule struct {
+	Copies int			`toml:"copies" json:"copies"`
+	Dscp []int			`toml:"dscp" json:"dscp"`
+	Protocol string			`toml:"protocol" json:"protocol"`
+	Ports []int			`toml:"ports" json:"ports"`
+	MinSize int			`toml:"min_size" json:"min_size"`
+	MaxSize int			`toml:"max_size" json:"max_size"`
+}
+
+type RouteConfig struct {
+	Name string			`toml:"name" json:"name"`
+	Dst string			`toml:"dst" json:"dst"`
+	Dscp []int			`toml:"dscp" json:"dscp"`
+	Protocol string			`toml:"protocol" json:"protocol"`
+	Ports []int			`toml:"ports" json:"ports"`
+	Backends string			`toml:"backends" json:"backends"`
+	Fallback bool			`toml:"fallback" json:"fallback"`
+}
+
+type FecConfig struct {
+	Data int			`toml:"data" json:"data"`
+	Parity int			`toml:"parity" json:"parity"`
+	MaxParity int			`toml:"max_parity" json:"max_parity"`
+	Adaptive bool			`toml:"adaptive" json:"adaptive"`
+	Timeout string			`toml:"timeout" json:"timeout"`
+}
+
+type CryptoConfig struct {
+	Cipher string			`toml:"cipher" json:"cipher"`
+	Key string			`toml:"key" json:"key"`
+	KeyFile string			`toml:"key_file" json:"key_file"`
+	ReplayWindow int		`toml:"replay_window" json:"replay_window"`
+}
+
+type NoiseConfig struct {
+	PrivateKey string		`toml:"private_key" json:"private_key"`
+	PrivateKeyFile string		`toml:"private_key_file" json:"private_key_file"`
+	AuthorizedKeys string		`toml:"authorized_keys" json:"authorized_keys"`
+	RekeyAfterTime string		`toml:"rekey_after_time" json:"rekey_after_time"`
+	RekeyAfterBytes uint64		`toml:"rekey_after_bytes" json:"rekey_after_bytes"`
+	ReplayWindow int		`toml:"replay_window" json:"replay_window"`
+	SessionTimeout string		`toml:"session_timeout" json:"session_timeout"`
+}
+
+type CookieConfig struct {
+	LoadThreshold float64		`toml:"load_threshold" json:"load_threshold"`
+	SecretLifetime string		`toml:"secret_lifetime" json:"secret_lifetime"`
+}
+
+type AclConfig struct {
+	ClientsAllow []string		`toml:"clients_allow" json:"clients_allow"`
+	ClientsDeny []string		`toml:"clients_deny" json:"clients_deny"`
+	Default string			`toml:"default" json:"default"`
+	Rules []AclRule			`toml:"rules" json:"rules"`
+}
+
+type AclRule struct {
+	Name string			`toml:"name" json:"name"`
+	Src string			`toml:"src" json:"src"`
+	Dst string			`toml:"dst" json:"dst"`
+	Protocol string			`toml:"protocol" json:"protocol"`
+	Ports []int			`toml:"ports" json:"ports"`
+	Action string			`toml:"action" json:"action"`
+}
+
+type ShapingConfig struct {
+	ClientPackets float64		`toml:"client_packets" json:"client_packets"`
+	ClientBytes string		`toml:"client_bytes" json:"client_bytes"`
+	Burst string			`toml:"burst" json:"burst"`
+	MaxDelay string			`toml:"max_delay" json:"max_delay"`
+}
+
+type QosConfig struct {
+	Scheduler string		`toml:"scheduler" json:"scheduler"`
+	Rate string			`toml:"rate" json:"rate"`
+	DefaultClass string		`toml:"default_class" json:"default_class"`
+	Classes []QosClass		`toml:"classes" json:"classes"`
+}
+
+type QosClass struct {
+	Name string			`toml:"name" json:"name"`
+	Dscp []int			`toml:"dscp" json:"dscp"`
+	Weight int			`toml:"weight" json:"weight"`
+	Depth int			`toml:"depth" json:"depth"`
 }
 
 type LoggingConfig struct {
@@ -19,13 +134,70 @@ type LoggingConfig struct {
 
 type DiscoveryConfig struct {
 	Kind	string			`toml:"kind" json:"kind"`
+	Interval string			`toml:"interval" json:"interval"`
+	MaxRetryWait string		`toml:"max_retry_wait" json:"max_retry_wait"`
+	Precedence int			`toml:"precedence" json:"precedence"`
+	Labels map[string]string	`toml:"labels" json:"labels"`
+	Resolver string			`toml:"resolver" json:"resolver"`
+	ResolveTimeout string		`toml:"resolve_timeout" json:"resolve_timeout"`
+	ResolveMinTtl string		`toml:"resolve_min_ttl" json:"resolve_min_ttl"`
+	ResolveFamilies []string	`toml:"resolve_families" json:"resolve_families"`
 	*StaticDiscoveryConfig
+	*DnsDiscoveryConfig
+	*FileDiscoveryConfig
+	*ExecDiscoveryConfig
+	*HttpDiscoveryConfig
+	*ConsulDiscoveryConfig
+	*KubernetesDiscoveryConfig
 }
 
 type StaticDiscoveryConfig struct {
 	StaticList []string	`toml:"static_list" json:"static_list"`
 }
 
+type DnsDiscoveryConfig struct {
+	DnsServer string	`toml:"dns_server" json:"dns_server"`
+	DnsName string		`toml:"dns_name" json:"dns_name"`
+	DnsType string		`toml:"dns_type" json:"dns_type"`
+	DnsPort int		`toml:"dns_port" json:"dns_port"`
+	DnsTimeout string	`toml:"dns_timeout" json:"dns_timeout"`
+	DnsMinTtl string	`toml:"dns_min_ttl" json:"dns_min_ttl"`
+}
+
+type FileDiscoveryConfig struct {
+	FilePath string		`toml:"file_path" json:"file_path"`
+	FileFormat string	`toml:"file_format" json:"file_format"`
+	FilePollInterval string	`toml:"file_poll_interval" json:"file_poll_interval"`
+}
+
+type ExecDiscoveryConfig struct {
+	ExecCommand []string	`toml:"exec_command" json:"exec_command"`
+	ExecPattern string	`toml:"exec_pattern" json:"exec_pattern"`
+	ExecTimeout string	`toml:"exec_timeout" json:"exec_timeout"`
+}
+
+type HttpDiscoveryConfig struct {
+	HttpUrl string			`toml:"http_url" json:"http_url"`
+	HttpHeaders map[string]string	`toml:"http_headers" json:"http_headers"`
+	HttpTimeout string		`toml:"http_timeout" json:"http_timeout"`
+}
+
+type ConsulDiscoveryConfig struct {
+	ConsulHost string		`toml:"consul_host" json:"consul_host"`
+	ConsulServiceName string	`toml:"consul_service_name" json:"consul_service_name"`
+	ConsulServiceTag string		`toml:"consul_service_tag" json:"consul_service_tag"`
+	ConsulDatacenter string		`toml:"consul_datacenter" json:"consul_datacenter"`
+	ConsulAuthToken string		`toml:"consul_auth_token" json:"consul_auth_token"`
+	ConsulWait string		`toml:"consul_wait" json:"consul_wait"`
+}
+
+type KubernetesDiscoveryConfig struct {
+	KubernetesKubeconfig string	`toml:"kubernetes_kubeconfig" json:"kubernetes_kubeconfig"`
+	KubernetesNamespace string	`toml:"kubernetes_namespace" json:"kubernetes_namespace"`
+	KubernetesService string	`toml:"kubernetes_service" json:"kubernetes_service"`
+	KubernetesPortName string	`toml:"kubernetes_port_name" json:"kubernetes_port_name"`
+}
+
 type HealthcheckConfig struct {
 	Kind     string `toml:"kind" json:"kind"`
 	Interval string `toml:"interval" json:"interval"`
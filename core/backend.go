@@ -19,6 +19,13 @@ type Backend struct {
 	Target
 	Priority int          `json:"priority"`
 	Weight   int          `json:"weight"`
+	Mtu      int          `json:"mtu"`
+	Key      string       `json:"key"`
+	Rate     float64      `json:"rate"`
+	Dscp     string       `json:"dscp"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Hostname string       `json:"hostname,omitempty"`
+	Draining bool         `json:"draining"`
 	Stats    BackendStats `json:"stats"`
 }
 
@@ -52,6 +59,13 @@ func (this *Backend) MergeFrom(other Backend) *Backend {
 
 	this.Priority = other.Priority
 	this.Weight = other.Weight
+	this.Mtu = other.Mtu
+	this.Key = other.Key
+	this.Rate = other.Rate
+	this.Dscp = other.Dscp
+	this.Labels = other.Labels
+	this.Hostname = other.Hostname
+	this.Draining = other.Draining
 
 	return this
 }
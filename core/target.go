@@ -5,12 +5,28 @@
  */
 package core
 
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
 /**
- * Target host and port
+ * Target host and port, with optional
+ * local binding of traffic to the target
  */
 type Target struct {
 	Host string `json:"host"`
 	Port string `json:"port"`
+
+	/* Local source address */
+	Source string `json:"source,omitempty"`
+
+	/* Local interface, SO_BINDTODEVICE */
+	Interface string `json:"interface,omitempty"`
+
+	/* Firewall mark, SO_MARK */
+	Mark int `json:"mark,omitempty"`
 }
 
 /**
@@ -18,7 +34,10 @@ type Target struct {
  */
 func (t *Target) EqualTo(other Target) bool {
 	return t.Host == other.Host &&
-		t.Port == other.Port
+		t.Port == other.Port &&
+		t.Source == other.Source &&
+		t.Interface == other.Interface &&
+		t.Mark == other.Mark
 }
 
 /**
@@ -26,12 +45,29 @@ func (t *Target) EqualTo(other Target) bool {
  * host:port
  */
 func (this *Target) Address() string {
-	return this.Host + ":" + this.Port
+	return net.JoinHostPort(this.Host, this.Port)
 }
 
 /**
  * To String conversion
+ * host:port, followed by local binding if any
  */
 func (this *Target) String() string {
-	return this.Address()
+
+	binding := []string{}
+	if this.Source != "" {
+		binding = append(binding, "source="+this.Source)
+	}
+	if this.Interface != "" {
+		binding = append(binding, "interface="+this.Interface)
+	}
+	if this.Mark != 0 {
+		binding = append(binding, "mark="+strconv.Itoa(this.Mark))
+	}
+
+	if len(binding) == 0 {
+		return this.Address()
+	}
+
+	return this.Address() + "@" + strings.Join(binding, ",")
 }
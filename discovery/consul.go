@@ -0,0 +1,287 @@
+/**
+ * consul.go - consul health service discovery implementation
+ */
+
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"../config"
+	"../core"
+	"../logging"
+)
+
+const (
+	CONSUL_DEFAULT_HOST       = "http://127.0.0.1:8500"
+	CONSUL_DEFAULT_WAIT       = 5 * time.Minute
+	CONSUL_DEFAULT_RETRY_WAIT = 5 * time.Second
+	CONSUL_DEFAULT_INTERVAL   = 10 * time.Second
+)
+
+/**
+ * Entry of consul /v1/health/service response
+ */
+type consulEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Tags    []string
+		Meta    map[string]string
+		Weights struct {
+			Passing int
+		}
+	}
+	Checks []struct {
+		Status string
+	}
+}
+
+/**
+ * Consul watcher state, used only from discovery goroutine
+ */
+type consulWatcher struct {
+	cfg    config.ConsulDiscoveryConfig
+	client *http.Client
+	wait   time.Duration
+
+	/* Cancels blocking query on stop */
+	ctx    context.Context
+	cancel func()
+
+	/* Index of last blocking query */
+	index uint64
+
+	/* If agent returns index, otherwise queries are repeated on interval */
+	blocking bool
+	interval time.Duration
+}
+
+/**
+ * Creates new consul discovery
+ */
+func NewConsulDiscovery(cfg config.DiscoveryConfig) interface{} {
+
+	consulCfg := config.ConsulDiscoveryConfig{}
+	if cfg.ConsulDiscoveryConfig != nil {
+		consulCfg = *cfg.ConsulDiscoveryConfig
+	}
+
+	wait := parseDurationOr(consulCfg.ConsulWait, CONSUL_DEFAULT_WAIT)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	w := &consulWatcher{
+		cfg:      consulCfg,
+		wait:     wait,
+		interval: parseDurationOr(cfg.Interval, CONSUL_DEFAULT_INTERVAL),
+		ctx:    ctx,
+		cancel: cancel,
+		client: &http.Client{
+			// consul adds up to wait/16 jitter to blocking queries
+			Timeout: wait + wait/16 + 10*time.Second,
+		},
+	}
+
+	d := Discovery{
+		opts:  DiscoveryOpts{CONSUL_DEFAULT_RETRY_WAIT},
+		cfg:   cfg,
+		fetch:  w.fetch,
+		wait:   w.next,
+		cancel: w.cancel,
+	}
+
+	return &d
+}
+
+/**
+ * Get passing instances of service, blocking until they change
+ * after the first call
+ */
+func (this *consulWatcher) fetch(cfg config.DiscoveryConfig) (*[]core.Backend, error) {
+
+	if this.cfg.ConsulServiceName == "" {
+		return nil, errors.New("consul_service_name is not set")
+	}
+
+	for {
+		previous := this.index
+
+		entries, err := this.query()
+		if err != nil {
+			return nil, err
+		}
+
+		if previous != 0 && this.index == previous {
+			continue
+		}
+
+		return consulBackends(entries), nil
+	}
+}
+
+/**
+ * Wait for next fetch. Blocking fetch itself waits until service
+ * changes, without index queries are repeated on interval
+ */
+func (this *consulWatcher) next(stop <-chan bool) {
+	if !this.blocking {
+		sleep(this.interval, stop)
+	}
+}
+
+/**
+ * Do blocking query of health endpoint, updating index
+ */
+func (this *consulWatcher) query() ([]consulEntry, error) {
+
+	host := this.cfg.ConsulHost
+	if host == "" {
+		host = CONSUL_DEFAULT_HOST
+	}
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+
+	query := url.Values{}
+	query.Set("passing", "1")
+	if this.cfg.ConsulServiceTag != "" {
+		query.Set("tag", this.cfg.ConsulServiceTag)
+	}
+	if this.cfg.ConsulDatacenter != "" {
+		query.Set("dc", this.cfg.ConsulDatacenter)
+	}
+	if this.index > 0 {
+		query.Set("index", strconv.FormatUint(this.index, 10))
+		query.Set("wait", strconv.Itoa(int(this.wait/time.Second))+"s")
+	}
+
+	req, err := http.NewRequestWithContext(this.ctx, "GET", strings.TrimSuffix(host, "/")+"/v1/health/service/"+url.PathEscape(this.cfg.ConsulServiceName)+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if this.cfg.ConsulAuthToken != "" {
+		req.Header.Set("X-Consul-Token", this.cfg.ConsulAuthToken)
+	}
+
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Unexpected status " + resp.Status + " from consul")
+	}
+
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	// missing or zero index means query can't block, it's not
+	// forced to some value, as that would make next query return
+	// at once and spin
+	index, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil || index == 0 {
+		this.index = 0
+		this.blocking = false
+		return entries, nil
+	}
+	this.blocking = true
+
+	// index going backwards means it should be reset
+	if index < this.index {
+		index = 0
+	}
+	this.index = index
+
+	return entries, nil
+}
+
+/**
+ * Convert passing consul entries to backends.
+ * Weight and priority are taken from service meta or
+ * weight=N / priority=N tags, other meta and key=value
+ * tags become labels
+ */
+func consulBackends(entries []consulEntry) *[]core.Backend {
+
+	log := logging.For("discovery/consul")
+
+	backends := []core.Backend{}
+
+	for _, entry := range entries {
+
+		passing := true
+		for _, check := range entry.Checks {
+			if check.Status != "passing" {
+				passing = false
+			}
+		}
+		if !passing {
+			continue
+		}
+
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+
+		backendLabels := map[string]string{}
+		for _, tag := range entry.Service.Tags {
+			if kv := strings.SplitN(tag, "=", 2); len(kv) == 2 {
+				backendLabels[kv[0]] = kv[1]
+			}
+		}
+		for k, v := range entry.Service.Meta {
+			backendLabels[k] = v
+		}
+
+		backend := core.Backend{
+			Target: core.Target{
+				Host: host,
+				Port: strconv.Itoa(entry.Service.Port),
+			},
+			Weight:   entry.Service.Weights.Passing,
+			Priority: 1,
+		}
+
+		if v, ok := backendLabels["weight"]; ok {
+			if weight, err := strconv.Atoi(v); err == nil {
+				backend.Weight = weight
+			} else {
+				log.Warn("Bad weight ", v, " of ", backend.Target.String())
+			}
+			delete(backendLabels, "weight")
+		}
+		if v, ok := backendLabels["priority"]; ok {
+			if priority, err := strconv.Atoi(v); err == nil {
+				backend.Priority = priority
+			} else {
+				log.Warn("Bad priority ", v, " of ", backend.Target.String())
+			}
+			delete(backendLabels, "priority")
+		}
+
+		if backend.Weight <= 0 {
+			backend.Weight = 1
+		}
+		backend.Labels = validLabels("consul", backend.Target, backendLabels)
+		backend.Stats.Live = true
+
+		backends = append(backends, backend)
+	}
+
+	return &backends
+}
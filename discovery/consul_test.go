@@ -0,0 +1,225 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"../config"
+	"../core"
+)
+
+/**
+ * Fake consul response to blocking query
+ */
+type consulResponse struct {
+	index string
+	body  string
+}
+
+/**
+ * Fake consul agent, answers queries with queued responses
+ */
+type fakeConsul struct {
+	t         *testing.T
+	mutex     sync.Mutex
+	responses []consulResponse
+
+	/* Index and wait params of queries */
+	queries []string
+}
+
+func (this *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	query := r.URL.Query()
+	if r.URL.Path != "/v1/health/service/tun" {
+		this.t.Errorf("unexpected path %s", r.URL.Path)
+	}
+	if query.Get("passing") != "1" || query.Get("tag") != "edge" || query.Get("dc") != "dc1" {
+		this.t.Errorf("unexpected query %s", r.URL.RawQuery)
+	}
+	if r.Header.Get("X-Consul-Token") != "secret" {
+		this.t.Errorf("token is not sent")
+	}
+	this.queries = append(this.queries, query.Get("index")+"/"+query.Get("wait"))
+
+	if len(this.responses) == 0 {
+		this.t.Errorf("unexpected query %s", r.URL.RawQuery)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	response := this.responses[0]
+	this.responses = this.responses[1:]
+
+	if response.index != "" {
+		w.Header().Set("X-Consul-Index", response.index)
+	}
+	fmt.Fprint(w, response.body)
+}
+
+func consulService(address string, port int, tags string, meta string, status string) string {
+	return `{"Node":{"Address":"192.168.0.1"},` +
+		`"Service":{"Address":"` + address + `","Port":` + fmt.Sprint(port) + `,"Tags":[` + tags + `],"Meta":{` + meta + `},"Weights":{"Passing":3}},` +
+		`"Checks":[{"Status":"passing"},{"Status":"` + status + `"}]}`
+}
+
+func fetchConsul(t *testing.T, w *consulWatcher) map[string]core.Backend {
+	backends, err := w.fetch(config.DiscoveryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := map[string]core.Backend{}
+	for _, b := range *backends {
+		result[b.Target.String()] = b
+	}
+	return result
+}
+
+func TestConsulBlockingQuery(t *testing.T) {
+
+	first := `[` +
+		consulService("10.0.0.1", 4000, `"weight=5","priority=2","zone=a","edge","team=a b"`, `"env":"prod","bad key":"x"`, "passing") + `,` +
+		consulService("", 4001, ``, `"priority":"3"`, "passing") + `,` +
+		consulService("10.0.0.3", 4000, ``, ``, "critical") +
+		`]`
+	second := `[` + consulService("10.0.0.4", 4000, ``, ``, "passing") + `]`
+	third := `[` + consulService("10.0.0.5", 4000, ``, ``, "passing") + `]`
+
+	api := &fakeConsul{t: t, responses: []consulResponse{
+		{"10", first},
+		// wait timed out without changes
+		{"10", first},
+		{"12", second},
+		// index went backwards
+		{"5", third},
+		{"6", third},
+	}}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := &consulWatcher{
+		cfg: config.ConsulDiscoveryConfig{
+			ConsulHost:        strings.TrimPrefix(server.URL, "http://"),
+			ConsulServiceName: "tun",
+			ConsulServiceTag:  "edge",
+			ConsulDatacenter:  "dc1",
+			ConsulAuthToken:   "secret",
+		},
+		client: &http.Client{Timeout: time.Second},
+		wait:   time.Minute,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	// only passing instances, weight and priority from tags and meta, invalid labels are dropped
+	targets := fetchConsul(t, w)
+	if len(targets) != 2 {
+		t.Fatalf("backends %v", targets)
+	}
+	b := targets["10.0.0.1:4000"]
+	if b.Weight != 5 || b.Priority != 2 || len(b.Labels) != 2 || b.Labels["zone"] != "a" || b.Labels["env"] != "prod" || !b.Stats.Live {
+		t.Fatalf("tagged backend %+v", b)
+	}
+	// node address is used if service has none, weight is from consul weights
+	b = targets["192.168.0.1:4001"]
+	if b.Weight != 3 || b.Priority != 3 || b.Labels != nil {
+		t.Fatalf("node address backend %+v", b)
+	}
+
+	// unchanged index blocks again
+	if _, ok := fetchConsul(t, w)["10.0.0.4:4000"]; !ok {
+		t.Fatal("changed backends are not returned")
+	}
+
+	// index going backwards resets it
+	if _, ok := fetchConsul(t, w)["10.0.0.5:4000"]; !ok {
+		t.Fatal("backends after index reset are not returned")
+	}
+	if w.index != 0 {
+		t.Fatalf("index %d after going backwards", w.index)
+	}
+	fetchConsul(t, w)
+	if w.index != 6 {
+		t.Fatalf("index %d after reset", w.index)
+	}
+
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	if strings.Join(api.queries, ",") != "/,10/60s,10/60s,12/60s,/" {
+		t.Fatalf("queries %v", api.queries)
+	}
+}
+
+func TestConsulWithoutIndex(t *testing.T) {
+
+	service := `[` + consulService("10.0.0.1", 4000, ``, ``, "passing") + `]`
+
+	api := &fakeConsul{t: t, responses: []consulResponse{
+		{"", service},
+		{"0", service},
+		{"7", service},
+	}}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := &consulWatcher{
+		cfg: config.ConsulDiscoveryConfig{
+			ConsulHost:        server.URL,
+			ConsulServiceName: "tun",
+			ConsulServiceTag:  "edge",
+			ConsulDatacenter:  "dc1",
+			ConsulAuthToken:   "secret",
+		},
+		client:   &http.Client{Timeout: time.Second},
+		wait:     time.Minute,
+		interval: 50 * time.Millisecond,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	stop := make(chan bool)
+
+	// backends are returned and next query waits for interval
+	for i := 0; i < 2; i++ {
+		if _, ok := fetchConsul(t, w)["10.0.0.1:4000"]; !ok {
+			t.Fatal("backends without index are not returned")
+		}
+		if w.index != 0 || w.blocking {
+			t.Fatalf("index %d, blocking %v without index", w.index, w.blocking)
+		}
+		start := time.Now()
+		w.next(stop)
+		if time.Since(start) < w.interval {
+			t.Fatal("query without index is not delayed")
+		}
+	}
+
+	// agent returning index makes queries blocking again
+	fetchConsul(t, w)
+	if w.index != 7 || !w.blocking {
+		t.Fatalf("index %d, blocking %v", w.index, w.blocking)
+	}
+	start := time.Now()
+	w.next(stop)
+	if time.Since(start) >= w.interval {
+		t.Fatal("blocking query is delayed")
+	}
+
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	if strings.Join(api.queries, ",") != "/,/,/" {
+		t.Fatalf("queries %v", api.queries)
+	}
+}
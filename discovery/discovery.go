@@ -10,6 +10,9 @@ import (
 	"../config"
 	"../core"
 	"../logging"
+	"../utils/labels"
+	"reflect"
+	"sync"
 	"time"
 )
 
@@ -23,6 +26,12 @@ var registry = make(map[string]func(config.DiscoveryConfig) interface{})
  */
 func init() {
 	registry["static"] = NewStaticDiscovery
+	registry["dns"] = NewDnsDiscovery
+	registry["file"] = NewFileDiscovery
+	registry["exec"] = NewExecDiscovery
+	registry["http"] = NewHttpDiscovery
+	registry["consul"] = NewConsulDiscovery
+	registry["kubernetes"] = NewKubernetesDiscovery
 }
 
 /**
@@ -44,6 +53,11 @@ type DiscoveryOpts struct {
 	RetryWaitDuration time.Duration
 }
 
+const (
+	DEFAULT_RETRY_WAIT     = 1 * time.Second
+	DEFAULT_MAX_RETRY_WAIT = 1 * time.Minute
+)
+
 /**
  * Discovery
  */
@@ -64,6 +78,22 @@ type Discovery struct {
 	 */
 	opts DiscoveryOpts
 
+	/**
+	 * Blocks until next fetch is needed or stop is closed,
+	 * nil to wait for configured interval
+	 */
+	wait func(stop <-chan bool)
+
+	/**
+	 * Interrupts blocking fetch on stop, may be nil
+	 */
+	cancel func()
+
+	/**
+	 * Resolver of backends hostnames
+	 */
+	resolver *hostResolver
+
 	/**
 	 * Discovery configuration
 	 */
@@ -73,6 +103,12 @@ type Discovery struct {
 	 * Channel where to push newly discovered backends
 	 */
 	out chan ([]core.Backend)
+
+	/**
+	 * Closed on stop
+	 */
+	stop     chan bool
+	stopOnce sync.Once
 }
 
 /**
@@ -83,38 +119,158 @@ func (this *Discovery) Start() {
 	log := logging.For("discovery")
 
 	this.out = make(chan []core.Backend)
+	this.stop = make(chan bool)
+	this.resolver = newHostResolver(this.cfg)
 
-	interval := 0
+	interval := parseDurationOr(this.cfg.Interval, 0)
+	maxRetryWait := parseDurationOr(this.cfg.MaxRetryWait, DEFAULT_MAX_RETRY_WAIT)
 
 	go func() {
+		retryWait := time.Duration(0)
+
 		for {
 			backends, err := this.fetch(this.cfg)
 
-			if err != nil {
-				log.Fatal("Fetch backends error ", err)
+			if this.stopped() {
 				return
 			}
 
-			// cache
-			this.backends = backends
+			// keep cached backends, retrying with exponential backoff
+			if err != nil {
+				retryWait = backoff(retryWait, this.opts.RetryWaitDuration, maxRetryWait)
+				log.Error("Fetch backends error ", err, ", retrying in ", retryWait)
+				if !sleep(retryWait, this.stop) {
+					return
+				}
+				continue
+			}
+			retryWait = 0
 
-			// out
-			this.out <- *this.backends
+			if len(this.cfg.Labels) > 0 {
+				backends = withLabels(*backends, this.cfg.Labels)
+			}
+
+			// hostnames are resolved again on ttl until next fetch
+			next := this.next(interval)
+			for refetch := false; !refetch; {
+				resolved, expires := this.resolver.expand(*backends)
+
+				if !this.push(resolved) {
+					return
+				}
 
-			// exit gorouting if no cacheTtl
-			// used for static discovery
-			if interval == 0 {
+				if expires.IsZero() && next == nil {
+					// exit gorouting if nothing to wait for
+					// used for static discovery
+					return
+				}
+
+				var ok bool
+				refetch, ok = this.until(next, expires)
+				if !ok {
+					return
+				}
+			}
+
+			if this.stopped() {
 				return
 			}
 		}
 	}()
 }
 
+/**
+ * Push backends if changed, returns false if stopped
+ */
+func (this *Discovery) push(backends []core.Backend) bool {
+
+	if this.backends != nil && reflect.DeepEqual(backends, *this.backends) {
+		logging.For("discovery").Debug("Backends not changed")
+		return true
+	}
+
+	// cache
+	this.backends = &backends
+
+	// out
+	select {
+	case this.out <- *this.backends:
+		return true
+	case <-this.stop:
+		return false
+	}
+}
+
+/**
+ * Wait for next fetch or resolved addresses expiration,
+ * returns if fetch is needed and false if stopped
+ */
+func (this *Discovery) until(next <-chan bool, expires time.Time) (bool, bool) {
+
+	var expired <-chan time.Time
+	if !expires.IsZero() {
+		timer := time.NewTimer(time.Until(expires))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-next:
+		return true, true
+	case <-expired:
+		return false, true
+	case <-this.stop:
+		return false, false
+	}
+}
+
+/**
+ * Wait for next fetch in background, returned channel is closed
+ * when fetch is needed, nil if there is nothing to wait for
+ */
+func (this *Discovery) next(interval time.Duration) <-chan bool {
+
+	if this.wait == nil && interval <= 0 {
+		return nil
+	}
+
+	done := make(chan bool)
+	go func() {
+		if this.wait != nil {
+			this.wait(this.stop)
+		} else {
+			sleep(interval, this.stop)
+		}
+		close(done)
+	}()
+
+	return done
+}
+
 /**
  * Stop discovery
  */
 func (this *Discovery) Stop() {
-	// TODO: Add stopping function
+	this.stopOnce.Do(func() {
+		if this.stop != nil {
+			close(this.stop)
+		}
+		if this.cancel != nil {
+			this.cancel()
+		}
+	})
+}
+
+/**
+ * Check if discovery is stopped
+ */
+func (this *Discovery) stopped() bool {
+	select {
+	case <-this.stop:
+		return true
+	default:
+		return false
+	}
 }
 
 /**
@@ -123,3 +279,63 @@ func (this *Discovery) Stop() {
 func (this *Discovery) Discover() <-chan []core.Backend {
 	return this.out
 }
+
+/**
+ * Copy of backends with source labels added,
+ * labels of backend itself override source ones
+ */
+func withLabels(backends []core.Backend, sourceLabels map[string]string) *[]core.Backend {
+	result := make([]core.Backend, len(backends))
+	for i, b := range backends {
+		b.Labels = labels.Merge(sourceLabels, b.Labels)
+		result[i] = b
+	}
+	return &result
+}
+
+/**
+ * Labels of discovered backend that could be used in selectors,
+ * invalid ones are dropped with warning
+ */
+func validLabels(kind string, target core.Target, backendLabels map[string]string) map[string]string {
+	valid, invalid := labels.Validate(backendLabels)
+	if len(invalid) > 0 {
+		logging.For("discovery/"+kind).Warn("Dropping invalid labels ", invalid, " of ", target.String())
+	}
+	return valid
+}
+
+/**
+ * Next retry wait, doubling previous one up to max,
+ * which bounds initial wait of discovery kind too
+ */
+func backoff(previous time.Duration, initial time.Duration, max time.Duration) time.Duration {
+	if initial <= 0 {
+		initial = DEFAULT_RETRY_WAIT
+	}
+	if initial > max {
+		initial = max
+	}
+	if previous <= 0 {
+		return initial
+	}
+	if previous*2 > max {
+		return max
+	}
+	return previous * 2
+}
+
+/**
+ * Sleep for duration, returns false if stopped earlier
+ */
+func sleep(d time.Duration, stop <-chan bool) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
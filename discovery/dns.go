@@ -0,0 +1,251 @@
+/**
+ * dns.go - dns SRV / A / AAAA records discovery implementation
+ */
+
+package discovery
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"../config"
+	"../core"
+	"../logging"
+	"github.com/miekg/dns"
+)
+
+const (
+	DNS_DEFAULT_TYPE        = "srv"
+	DNS_DEFAULT_TIMEOUT     = 2 * time.Second
+	DNS_DEFAULT_MIN_TTL     = 5 * time.Second
+	DNS_DEFAULT_RETRY_WAIT  = 5 * time.Second
+	DNS_DEFAULT_RESOLV_CONF = "/etc/resolv.conf"
+)
+
+/**
+ * Dns resolver state, keeps ttl of last answer
+ */
+type dnsResolver struct {
+	sync.Mutex
+
+	cfg    config.DnsDiscoveryConfig
+	client *dns.Client
+	minTtl time.Duration
+	ttl    time.Duration
+}
+
+/**
+ * Creates new dns discovery
+ */
+func NewDnsDiscovery(cfg config.DiscoveryConfig) interface{} {
+
+	dnsCfg := config.DnsDiscoveryConfig{}
+	if cfg.DnsDiscoveryConfig != nil {
+		dnsCfg = *cfg.DnsDiscoveryConfig
+	}
+
+	resolver := &dnsResolver{
+		cfg:    dnsCfg,
+		client: &dns.Client{Timeout: parseDurationOr(dnsCfg.DnsTimeout, DNS_DEFAULT_TIMEOUT)},
+		minTtl: parseDurationOr(dnsCfg.DnsMinTtl, DNS_DEFAULT_MIN_TTL),
+	}
+
+	d := Discovery{
+		opts:  DiscoveryOpts{DNS_DEFAULT_RETRY_WAIT},
+		cfg:   cfg,
+		fetch: resolver.fetch,
+		wait:  resolver.wait,
+	}
+
+	return &d
+}
+
+/**
+ * Wait until records should be resolved again
+ */
+func (this *dnsResolver) wait(stop <-chan bool) {
+	this.Lock()
+	ttl := this.ttl
+	this.Unlock()
+
+	sleep(ttl, stop)
+}
+
+/**
+ * Resolve records into backends
+ */
+func (this *dnsResolver) fetch(cfg config.DiscoveryConfig) (*[]core.Backend, error) {
+
+	log := logging.For("discovery/dns")
+
+	if this.cfg.DnsName == "" {
+		return nil, errors.New("dns_name is not set")
+	}
+
+	kind := strings.ToLower(this.cfg.DnsType)
+	if kind == "" {
+		kind = DNS_DEFAULT_TYPE
+	}
+
+	var qtype uint16
+	switch kind {
+	case "srv":
+		qtype = dns.TypeSRV
+	case "a":
+		qtype = dns.TypeA
+	case "aaaa":
+		qtype = dns.TypeAAAA
+	default:
+		return nil, errors.New("Unknown dns_type " + this.cfg.DnsType)
+	}
+
+	if qtype != dns.TypeSRV && this.cfg.DnsPort <= 0 {
+		return nil, errors.New("dns_port is required for " + kind + " records")
+	}
+
+	server, err := nameserver(this.cfg.DnsServer)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(this.cfg.DnsName), qtype)
+
+	in, err := exchange(this.client, msg, server)
+	if err != nil {
+		return nil, err
+	}
+
+	if in.Rcode != dns.RcodeSuccess {
+		return nil, errors.New("Error resolving " + this.cfg.DnsName + ": " + dns.RcodeToString[in.Rcode])
+	}
+
+	backends := []core.Backend{}
+	var ttl uint32
+
+	for _, rr := range in.Answer {
+
+		var backend core.Backend
+
+		switch record := rr.(type) {
+		case *dns.SRV:
+			backend = core.Backend{
+				Target: core.Target{
+					Host: strings.TrimSuffix(record.Target, "."),
+					Port: strconv.Itoa(int(record.Port)),
+				},
+				Priority: int(record.Priority),
+				Weight:   int(record.Weight),
+			}
+			// zero weight means least preferred, not disabled
+			if backend.Weight == 0 {
+				backend.Weight = 1
+			}
+		case *dns.A:
+			backend = this.addressBackend(record.A)
+		case *dns.AAAA:
+			backend = this.addressBackend(record.AAAA)
+		default:
+			continue
+		}
+
+		if rr.Header().Rrtype != qtype {
+			continue
+		}
+
+		if len(backends) == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+
+		backend.Stats.Live = true
+		backends = append(backends, backend)
+	}
+
+	if len(backends) == 0 {
+		return nil, errors.New("No records found for " + this.cfg.DnsName)
+	}
+
+	this.Lock()
+	this.ttl = time.Duration(ttl) * time.Second
+	if this.ttl < this.minTtl {
+		this.ttl = this.minTtl
+	}
+	this.Unlock()
+
+	log.Debug("Resolved ", this.cfg.DnsName, " to ", backends, ", ttl ", ttl)
+
+	return &backends, nil
+}
+
+/**
+ * Backend from A / AAAA record with configured port
+ */
+func (this *dnsResolver) addressBackend(ip net.IP) core.Backend {
+	return core.Backend{
+		Target: core.Target{
+			Host: ip.String(),
+			Port: strconv.Itoa(this.cfg.DnsPort),
+		},
+		Priority: 1,
+		Weight:   1,
+	}
+}
+
+/**
+ * Dns server to query, configured or first one from resolv.conf
+ */
+func nameserver(configured string) (string, error) {
+
+	if configured != "" {
+		if _, _, err := net.SplitHostPort(configured); err == nil {
+			return configured, nil
+		}
+		return net.JoinHostPort(configured, "53"), nil
+	}
+
+	resolv, err := dns.ClientConfigFromFile(DNS_DEFAULT_RESOLV_CONF)
+	if err != nil {
+		return "", err
+	}
+	if len(resolv.Servers) == 0 {
+		return "", errors.New("No nameservers in " + DNS_DEFAULT_RESOLV_CONF)
+	}
+
+	return net.JoinHostPort(resolv.Servers[0], resolv.Port), nil
+}
+
+/**
+ * Send query, retrying over tcp if answer is truncated
+ */
+func exchange(client *dns.Client, msg *dns.Msg, server string) (*dns.Msg, error) {
+
+	in, _, err := client.Exchange(msg, server)
+	if err == nil && in.Truncated {
+		tcp := *client
+		tcp.Net = "tcp"
+		in, _, err = tcp.Exchange(msg, server)
+	}
+
+	return in, err
+}
+
+/**
+ * Parse optional duration, using default if empty or invalid
+ */
+func parseDurationOr(s string, def time.Duration) time.Duration {
+	if s == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		logging.For("discovery").Warn("Bad duration ", s, ", using ", def)
+		return def
+	}
+
+	return d
+}
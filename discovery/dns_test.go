@@ -0,0 +1,250 @@
+package discovery
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"../config"
+	"../core"
+	"github.com/miekg/dns"
+)
+
+/**
+ * Fake dns server answering on udp and tcp on the same port.
+ * Names in truncated are answered only over tcp
+ */
+type fakeDns struct {
+	mutex     sync.Mutex
+	records   map[string][]dns.RR
+	truncated map[string]bool
+	queries   []string
+
+	addr    string
+	servers []*dns.Server
+}
+
+func newFakeDns(t *testing.T) *fakeDns {
+	f := &fakeDns{records: map[string][]dns.RR{}, truncated: map[string]bool{}}
+
+	// tcp port may be taken when udp one is free, try a few
+	for i := 0; i < 10 && f.addr == ""; i++ {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := net.Listen("tcp", pc.LocalAddr().String())
+		if err != nil {
+			pc.Close()
+			continue
+		}
+		f.addr = pc.LocalAddr().String()
+		f.start(t, &dns.Server{PacketConn: pc, Handler: f})
+		f.start(t, &dns.Server{Listener: l, Handler: f})
+	}
+	if f.addr == "" {
+		t.Fatal("no free port for udp and tcp")
+	}
+
+	return f
+}
+
+func (this *fakeDns) start(t *testing.T, server *dns.Server) {
+	started := make(chan bool)
+	server.NotifyStartedFunc = func() { close(started) }
+	go server.ActivateAndServe()
+	<-started
+	this.servers = append(this.servers, server)
+}
+
+func (this *fakeDns) close() {
+	for _, s := range this.servers {
+		s.Shutdown()
+	}
+}
+
+func (this *fakeDns) set(records ...string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.records = map[string][]dns.RR{}
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic(err)
+		}
+		name := rr.Header().Name
+		this.records[name] = append(this.records[name], rr)
+	}
+}
+
+func (this *fakeDns) truncate(name string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.truncated[name] = true
+}
+
+func (this *fakeDns) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	q := r.Question[0]
+	tcp := w.LocalAddr().Network() == "tcp"
+	this.queries = append(this.queries, w.LocalAddr().Network()+" "+q.Name)
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	if this.truncated[q.Name] && !tcp {
+		m.Truncated = true
+		w.WriteMsg(m)
+		return
+	}
+
+	for _, rr := range this.records[q.Name] {
+		if rr.Header().Rrtype == q.Qtype {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	w.WriteMsg(m)
+}
+
+func newTestDnsResolver(server string, cfg config.DnsDiscoveryConfig) *dnsResolver {
+	cfg.DnsServer = server
+	return &dnsResolver{
+		cfg:    cfg,
+		client: &dns.Client{Timeout: time.Second},
+		minTtl: parseDurationOr(cfg.DnsMinTtl, DNS_DEFAULT_MIN_TTL),
+	}
+}
+
+func resolveTargets(t *testing.T, resolver *dnsResolver) map[string]core.Backend {
+	backends, err := resolver.fetch(config.DiscoveryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := map[string]core.Backend{}
+	for _, b := range *backends {
+		if !b.Stats.Live {
+			t.Fatalf("backend %v is not live", b.Target)
+		}
+		result[b.Target.String()] = b
+	}
+	return result
+}
+
+func TestDnsSrv(t *testing.T) {
+
+	server := newFakeDns(t)
+	defer server.close()
+
+	server.set(
+		"_tun._udp.example.com. 60 IN SRV 10 20 4000 a.example.com.",
+		"_tun._udp.example.com. 30 IN SRV 20 0 4001 b.example.com.",
+	)
+
+	resolver := newTestDnsResolver(server.addr, config.DnsDiscoveryConfig{DnsName: "_tun._udp.example.com"})
+	targets := resolveTargets(t, resolver)
+
+	if b := targets["a.example.com:4000"]; b.Priority != 10 || b.Weight != 20 {
+		t.Fatalf("first record %+v", b)
+	}
+	// zero weight is least preferred, not disabled
+	if b := targets["b.example.com:4001"]; b.Priority != 20 || b.Weight != 1 {
+		t.Fatalf("second record %+v", b)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("resolved %v", targets)
+	}
+	if resolver.ttl != 30*time.Second {
+		t.Fatalf("ttl %v, want minimal one", resolver.ttl)
+	}
+}
+
+func TestDnsAddresses(t *testing.T) {
+
+	server := newFakeDns(t)
+	defer server.close()
+
+	server.set(
+		"tun.example.com. 1 IN A 10.0.0.1",
+		"tun.example.com. 1 IN A 10.0.0.2",
+		"tun.example.com. 1 IN AAAA 2001:db8::1",
+	)
+
+	resolver := newTestDnsResolver(server.addr, config.DnsDiscoveryConfig{DnsName: "tun.example.com", DnsType: "a"})
+	if _, err := resolver.fetch(config.DiscoveryConfig{}); err == nil {
+		t.Fatal("expected error without dns_port")
+	}
+
+	resolver.cfg.DnsPort = 4000
+	targets := resolveTargets(t, resolver)
+	if _, ok := targets["10.0.0.2:4000"]; !ok || len(targets) != 2 {
+		t.Fatalf("resolved A %v", targets)
+	}
+	if b := targets["10.0.0.1:4000"]; b.Priority != 1 || b.Weight != 1 {
+		t.Fatalf("A backend %+v", b)
+	}
+	// ttl below min_ttl is clamped
+	if resolver.ttl != DNS_DEFAULT_MIN_TTL {
+		t.Fatalf("ttl %v, want min ttl", resolver.ttl)
+	}
+
+	resolver.cfg.DnsType = "aaaa"
+	targets = resolveTargets(t, resolver)
+	if _, ok := targets["[2001:db8::1]:4000"]; !ok || len(targets) != 1 {
+		t.Fatalf("resolved AAAA %v", targets)
+	}
+}
+
+func TestDnsTtlResolvesAgain(t *testing.T) {
+
+	server := newFakeDns(t)
+	defer server.close()
+
+	server.set("tun.example.com. 0 IN A 10.0.0.1")
+
+	resolver := newTestDnsResolver(server.addr, config.DnsDiscoveryConfig{
+		DnsName:   "tun.example.com",
+		DnsType:   "a",
+		DnsPort:   4000,
+		DnsMinTtl: "100ms",
+	})
+	if _, ok := resolveTargets(t, resolver)["10.0.0.1:4000"]; !ok {
+		t.Fatal("first address is not resolved")
+	}
+
+	server.set("tun.example.com. 0 IN A 10.0.0.2")
+
+	start := time.Now()
+	resolver.wait(make(chan bool))
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("waited %v, want min ttl", elapsed)
+	}
+
+	if _, ok := resolveTargets(t, resolver)["10.0.0.2:4000"]; !ok {
+		t.Fatal("changed address is not resolved")
+	}
+}
+
+func TestDnsTruncatedFallsBackToTcp(t *testing.T) {
+
+	server := newFakeDns(t)
+	defer server.close()
+
+	server.set("_tun._udp.example.com. 60 IN SRV 10 10 4000 a.example.com.")
+	server.truncate("_tun._udp.example.com.")
+
+	resolver := newTestDnsResolver(server.addr, config.DnsDiscoveryConfig{DnsName: "_tun._udp.example.com"})
+	if _, ok := resolveTargets(t, resolver)["a.example.com:4000"]; !ok {
+		t.Fatal("record from tcp answer is not resolved")
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if len(server.queries) != 2 || server.queries[0] != "udp _tun._udp.example.com." || server.queries[1] != "tcp _tun._udp.example.com." {
+		t.Fatalf("queries %v", server.queries)
+	}
+}
@@ -0,0 +1,83 @@
+/**
+ * exec.go - exec discovery implementation, parses command output
+ */
+
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"../config"
+	"../core"
+	"../utils/parsers"
+)
+
+const (
+	EXEC_DEFAULT_INTERVAL   = 30 * time.Second
+	EXEC_DEFAULT_TIMEOUT    = 10 * time.Second
+	EXEC_DEFAULT_RETRY_WAIT = 5 * time.Second
+)
+
+/**
+ * Creates new exec discovery
+ */
+func NewExecDiscovery(cfg config.DiscoveryConfig) interface{} {
+
+	interval := parseDurationOr(cfg.Interval, EXEC_DEFAULT_INTERVAL)
+
+	d := Discovery{
+		opts:  DiscoveryOpts{EXEC_DEFAULT_RETRY_WAIT},
+		cfg:   cfg,
+		fetch: execFetch,
+		wait: func(stop <-chan bool) {
+			sleep(interval, stop)
+		},
+	}
+
+	return &d
+}
+
+/**
+ * Run command and parse its stdout as backend lines
+ */
+func execFetch(cfg config.DiscoveryConfig) (*[]core.Backend, error) {
+
+	execCfg := cfg.ExecDiscoveryConfig
+	if execCfg == nil || len(execCfg.ExecCommand) == 0 {
+		return nil, errors.New("exec_command is not set")
+	}
+
+	pattern := execCfg.ExecPattern
+	if pattern == "" {
+		pattern = parsers.DEFAULT_BACKEND_PATTERN
+	}
+
+	// parser panics on bad pattern
+	if _, err := regexp.Compile(pattern); err != nil {
+		return nil, err
+	}
+
+	timeout := parseDurationOr(execCfg.ExecTimeout, EXEC_DEFAULT_TIMEOUT)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, execCfg.ExecCommand[0], execCfg.ExecCommand[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.New(err.Error() + ": " + msg)
+		}
+		return nil, err
+	}
+
+	return parseLineBackends(stdout.Bytes(), pattern)
+}
@@ -0,0 +1,282 @@
+/**
+ * file.go - file discovery implementation, reloads file on change
+ */
+
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"../config"
+	"../core"
+	"../logging"
+	"../utils/parsers"
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	FILE_DEFAULT_POLL_INTERVAL = 5 * time.Second
+	FILE_DEFAULT_RETRY_WAIT    = 5 * time.Second
+	FILE_DEBOUNCE              = 100 * time.Millisecond
+)
+
+/**
+ * Backends file state, used only from discovery goroutine
+ */
+type fileWatcher struct {
+	cfg config.FileDiscoveryConfig
+
+	/* Directory watcher, nil if file is polled */
+	watcher *fsnotify.Watcher
+
+	pollInterval time.Duration
+
+	/* File state on last read */
+	modTime time.Time
+	size    int64
+}
+
+/**
+ * Creates new file discovery
+ */
+func NewFileDiscovery(cfg config.DiscoveryConfig) interface{} {
+
+	log := logging.For("discovery/file")
+
+	fileCfg := config.FileDiscoveryConfig{}
+	if cfg.FileDiscoveryConfig != nil {
+		fileCfg = *cfg.FileDiscoveryConfig
+	}
+
+	w := &fileWatcher{
+		cfg:          fileCfg,
+		pollInterval: parseDurationOr(fileCfg.FilePollInterval, FILE_DEFAULT_POLL_INTERVAL),
+	}
+
+	// watch directory, as file is usually replaced by rename
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(filepath.Dir(fileCfg.FilePath))
+		if err != nil {
+			watcher.Close()
+		}
+	}
+	if err != nil {
+		log.Warn("Unable to watch ", fileCfg.FilePath, ", polling every ", w.pollInterval, ": ", err)
+	} else {
+		w.watcher = watcher
+	}
+
+	d := Discovery{
+		opts:  DiscoveryOpts{FILE_DEFAULT_RETRY_WAIT},
+		cfg:   cfg,
+		fetch: w.fetch,
+		wait:  w.wait,
+	}
+
+	if w.watcher != nil {
+		d.cancel = func() {
+			w.watcher.Close()
+		}
+	}
+
+	return &d
+}
+
+/**
+ * Read backends from file
+ */
+func (this *fileWatcher) fetch(cfg config.DiscoveryConfig) (*[]core.Backend, error) {
+
+	if this.cfg.FilePath == "" {
+		return nil, errors.New("file_path is not set")
+	}
+
+	info, err := os.Stat(this.cfg.FilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(this.cfg.FilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	this.modTime = info.ModTime()
+	this.size = info.Size()
+
+	format := strings.ToLower(this.cfg.FileFormat)
+	if format == "" || format == "auto" {
+		format = "lines"
+		if filepath.Ext(this.cfg.FilePath) == ".json" || bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+			format = "json"
+		}
+	}
+
+	switch format {
+	case "json":
+		return parseJsonBackends(data)
+	case "lines":
+		return parseLineBackends(data, parsers.DEFAULT_BACKEND_PATTERN)
+	default:
+		return nil, errors.New("Unknown file_format " + this.cfg.FileFormat)
+	}
+}
+
+/**
+ * Wait until file is changed
+ */
+func (this *fileWatcher) wait(stop <-chan bool) {
+
+	log := logging.For("discovery/file")
+
+	for this.watcher != nil {
+		select {
+		case <-stop:
+			return
+		case event, ok := <-this.watcher.Events:
+			if !ok {
+				this.watcher = nil
+				break
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			this.settle()
+			if this.changed() {
+				return
+			}
+		case err, ok := <-this.watcher.Errors:
+			if !ok {
+				this.watcher = nil
+				break
+			}
+			log.Warn("Error watching ", this.cfg.FilePath, ": ", err)
+		}
+	}
+
+	for sleep(this.pollInterval, stop) {
+		if this.changed() {
+			return
+		}
+	}
+}
+
+/**
+ * Skip events of the same file update
+ */
+func (this *fileWatcher) settle() {
+	timer := time.NewTimer(FILE_DEBOUNCE)
+	defer timer.Stop()
+
+	for {
+		select {
+		case _, ok := <-this.watcher.Events:
+			if !ok {
+				return
+			}
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+/**
+ * Check if file differs from last read one.
+ * Events of other files in directory are filtered here too,
+ * which also handles symlinked files
+ */
+func (this *fileWatcher) changed() bool {
+	info, err := os.Stat(this.cfg.FilePath)
+	if err != nil {
+		return true
+	}
+
+	return !info.ModTime().Equal(this.modTime) || info.Size() != this.size
+}
+
+/**
+ * Parse json array of backend lines and / or backend objects
+ */
+func parseJsonBackends(data []byte) (*[]core.Backend, error) {
+
+	log := logging.For("discovery/file")
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, err
+	}
+
+	backends := []core.Backend{}
+	for _, item := range items {
+
+		var line string
+		if err := json.Unmarshal(item, &line); err == nil {
+			backends = append(backends, *parseBackendLines([]string{line}, parsers.DEFAULT_BACKEND_PATTERN)...)
+			continue
+		}
+
+		backend := core.Backend{Weight: 1, Priority: 1}
+		if err := json.Unmarshal(item, &backend); err != nil {
+			log.Warn("Cant parse ", string(item), ": ", err)
+			continue
+		}
+		backend.Stats = core.BackendStats{Live: true}
+		backends = append(backends, backend)
+	}
+
+	return &backends, nil
+}
+
+/**
+ * Parse backend line per line, as in static_list.
+ * Empty lines and lines starting with # are skipped
+ */
+func parseLineBackends(data []byte, pattern string) (*[]core.Backend, error) {
+
+	var lines []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return parseBackendLines(lines, pattern), nil
+}
+
+/**
+ * Parse backend lines with pattern skipping invalid ones
+ */
+func parseBackendLines(lines []string, pattern string) *[]core.Backend {
+
+	log := logging.For("discovery")
+
+	backends := []core.Backend{}
+	for _, s := range lines {
+		backend, err := parsers.ParseBackend(s, pattern)
+		if err != nil {
+			log.Warn(err)
+			continue
+		}
+		backend.Stats.Live = true
+		backends = append(backends, *backend)
+	}
+
+	return &backends
+}
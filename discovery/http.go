@@ -0,0 +1,182 @@
+/**
+ * http.go - http json discovery implementation
+ */
+
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"../config"
+	"../core"
+	"../logging"
+)
+
+const (
+	HTTP_DEFAULT_INTERVAL   = 30 * time.Second
+	HTTP_DEFAULT_TIMEOUT    = 10 * time.Second
+	HTTP_DEFAULT_RETRY_WAIT = 5 * time.Second
+)
+
+/**
+ * Backend in http discovery response
+ */
+type httpBackend struct {
+	Host     string            `json:"host"`
+	Port     jsonPort          `json:"port"`
+	Weight   int               `json:"weight"`
+	Priority int               `json:"priority"`
+	Labels   map[string]string `json:"labels"`
+}
+
+/**
+ * Port given either as number or string
+ */
+type jsonPort string
+
+func (this *jsonPort) UnmarshalJSON(data []byte) error {
+	var port int
+	if err := json.Unmarshal(data, &port); err == nil {
+		*this = jsonPort(strconv.Itoa(port))
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New("Bad port " + string(data))
+	}
+	*this = jsonPort(s)
+
+	return nil
+}
+
+/**
+ * Http poller state, used only from discovery goroutine
+ */
+type httpPoller struct {
+	cfg    config.HttpDiscoveryConfig
+	client *http.Client
+
+	/* ETag and backends of last response */
+	etag     string
+	backends []core.Backend
+}
+
+/**
+ * Creates new http discovery
+ */
+func NewHttpDiscovery(cfg config.DiscoveryConfig) interface{} {
+
+	httpCfg := config.HttpDiscoveryConfig{}
+	if cfg.HttpDiscoveryConfig != nil {
+		httpCfg = *cfg.HttpDiscoveryConfig
+	}
+
+	p := &httpPoller{
+		cfg: httpCfg,
+		client: &http.Client{
+			Timeout: parseDurationOr(httpCfg.HttpTimeout, HTTP_DEFAULT_TIMEOUT),
+		},
+	}
+
+	interval := parseDurationOr(cfg.Interval, HTTP_DEFAULT_INTERVAL)
+
+	d := Discovery{
+		opts:  DiscoveryOpts{HTTP_DEFAULT_RETRY_WAIT},
+		cfg:   cfg,
+		fetch: p.fetch,
+		wait: func(stop <-chan bool) {
+			sleep(interval, stop)
+		},
+	}
+
+	return &d
+}
+
+/**
+ * Poll url, returning cached backends if not modified
+ */
+func (this *httpPoller) fetch(cfg config.DiscoveryConfig) (*[]core.Backend, error) {
+
+	log := logging.For("discovery/http")
+
+	if this.cfg.HttpUrl == "" {
+		return nil, errors.New("http_url is not set")
+	}
+
+	req, err := http.NewRequest("GET", this.cfg.HttpUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	for k, v := range this.cfg.HttpHeaders {
+		req.Header.Set(k, v)
+	}
+	if this.etag != "" {
+		req.Header.Set("If-None-Match", this.etag)
+	}
+
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && this.backends != nil {
+		log.Debug("Backends not modified at ", this.cfg.HttpUrl)
+		backends := append([]core.Backend{}, this.backends...)
+		return &backends, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Unexpected status " + resp.Status + " from " + this.cfg.HttpUrl)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []httpBackend
+	if err := json.Unmarshal(body, &items); err != nil {
+		return nil, err
+	}
+
+	backends := []core.Backend{}
+	for _, item := range items {
+		if item.Host == "" || item.Port == "" {
+			log.Warn("Skipping backend without host or port from ", this.cfg.HttpUrl)
+			continue
+		}
+
+		backend := core.Backend{
+			Target: core.Target{
+				Host: item.Host,
+				Port: string(item.Port),
+			},
+			Weight:   item.Weight,
+			Priority: item.Priority,
+		}
+		backend.Labels = validLabels("http", backend.Target, item.Labels)
+		if backend.Weight == 0 {
+			backend.Weight = 1
+		}
+		if backend.Priority == 0 {
+			backend.Priority = 1
+		}
+		backend.Stats.Live = true
+
+		backends = append(backends, backend)
+	}
+
+	this.etag = resp.Header.Get("ETag")
+	this.backends = append([]core.Backend{}, backends...)
+
+	return &backends, nil
+}
@@ -0,0 +1,148 @@
+package discovery
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"../config"
+)
+
+const testHttpBody = `[
+	{"host": "10.0.0.1", "port": 4000, "weight": 5, "priority": 2, "labels": {"zone": "a", "bad key": "x", "team": "a b"}},
+	{"host": "10.0.0.2", "port": "4001"},
+	{"host": "", "port": 4002}
+]`
+
+func TestHttpNotModified(t *testing.T) {
+
+	var mutex sync.Mutex
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests++
+
+		if r.Header.Get("X-Token") != "secret" {
+			t.Errorf("configured header is not sent")
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if requests > 1 {
+			t.Errorf("request %d without etag", requests)
+		}
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, testHttpBody)
+	}))
+	defer server.Close()
+
+	poller := &httpPoller{
+		cfg: config.HttpDiscoveryConfig{
+			HttpUrl:     server.URL,
+			HttpHeaders: map[string]string{"X-Token": "secret"},
+		},
+		client: &http.Client{Timeout: time.Second},
+	}
+
+	for i := 0; i < 2; i++ {
+		backends, err := poller.fetch(config.DiscoveryConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// backend without host is skipped, invalid labels are dropped, defaults are applied
+		if len(*backends) != 2 {
+			t.Fatalf("fetch %d: backends %v", i, *backends)
+		}
+		b := (*backends)[0]
+		if b.Target.String() != "10.0.0.1:4000" || b.Weight != 5 || b.Priority != 2 || len(b.Labels) != 1 || b.Labels["zone"] != "a" || !b.Stats.Live {
+			t.Fatalf("fetch %d: first backend %+v", i, b)
+		}
+		b = (*backends)[1]
+		if b.Target.String() != "10.0.0.2:4001" || b.Weight != 1 || b.Priority != 1 {
+			t.Fatalf("fetch %d: second backend %+v", i, b)
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if requests != 2 {
+		t.Fatalf("%d requests", requests)
+	}
+}
+
+func TestHttpErrorStatus(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	poller := &httpPoller{
+		cfg:    config.HttpDiscoveryConfig{HttpUrl: server.URL},
+		client: &http.Client{Timeout: time.Second},
+	}
+	if _, err := poller.fetch(config.DiscoveryConfig{}); err == nil {
+		t.Fatal("expected error on 500")
+	}
+}
+
+func TestHttpTimeoutRetry(t *testing.T) {
+
+	var mutex sync.Mutex
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests++
+		first := requests == 1
+		mutex.Unlock()
+
+		// first request is slower than timeout
+		if first {
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+			}
+			return
+		}
+		fmt.Fprint(w, testHttpBody)
+	}))
+	defer server.Close()
+
+	d := New("http", config.DiscoveryConfig{
+		Interval:     "1h",
+		MaxRetryWait: "50ms",
+		HttpDiscoveryConfig: &config.HttpDiscoveryConfig{
+			HttpUrl:     server.URL,
+			HttpTimeout: "100ms",
+		},
+	})
+	d.Start()
+	defer d.Stop()
+
+	start := time.Now()
+	select {
+	case backends := <-d.Discover():
+		if len(backends) != 2 {
+			t.Fatalf("backends %v", backends)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no backends after retry")
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("backends in %v, before timeout and retry wait", elapsed)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if requests != 2 {
+		t.Fatalf("%d requests", requests)
+	}
+}
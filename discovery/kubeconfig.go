@@ -0,0 +1,313 @@
+/**
+ * kubeconfig.go - kubernetes api server connection, in-cluster or from kubeconfig
+ */
+
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	KUBERNETES_SERVICE_ACCOUNT_DIR = "/var/run/secrets/kubernetes.io/serviceaccount"
+	KUBERNETES_DEFAULT_NAMESPACE   = "default"
+	KUBERNETES_REQUEST_TIMEOUT     = 30 * time.Second
+)
+
+/**
+ * Kubernetes api server connection
+ */
+type kubeApi struct {
+	server    string
+	token     string
+	namespace string
+
+	/* Token is read again on every request if set, it's rotated */
+	tokenFile string
+
+	/* Client for requests, and for watches without overall timeout */
+	client      *http.Client
+	watchClient *http.Client
+}
+
+/**
+ * Subset of kubeconfig file used to connect to api server
+ */
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Contexts       []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Clusters []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTlsVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+/**
+ * Connect to api server using kubeconfig file,
+ * or service account if path is empty
+ */
+func newKubeApi(path string) (*kubeApi, error) {
+	if path == "" {
+		return inClusterKubeApi()
+	}
+	return kubeconfigKubeApi(path)
+}
+
+/**
+ * Connection from pod service account
+ */
+func inClusterKubeApi() (*kubeApi, error) {
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("Not running in kubernetes cluster and no kubeconfig given")
+	}
+
+	tokenFile := filepath.Join(KUBERNETES_SERVICE_ACCOUNT_DIR, "token")
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := ioutil.ReadFile(filepath.Join(KUBERNETES_SERVICE_ACCOUNT_DIR, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("Bad service account ca certificate")
+	}
+
+	namespace := KUBERNETES_DEFAULT_NAMESPACE
+	if ns, err := ioutil.ReadFile(filepath.Join(KUBERNETES_SERVICE_ACCOUNT_DIR, "namespace")); err == nil {
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	api := newKubeApiWithTls("https://"+net.JoinHostPort(host, port), strings.TrimSpace(string(token)), namespace, &tls.Config{RootCAs: pool})
+	api.tokenFile = tokenFile
+
+	return api, nil
+}
+
+/**
+ * Connection from current context of kubeconfig
+ */
+func kubeconfigKubeApi(path string) (*kubeApi, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg kubeconfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	// relative paths in kubeconfig are relative to its directory
+	dir := filepath.Dir(path)
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+
+	var clusterName, userName, namespace string
+	found := false
+	for _, c := range cfg.Contexts {
+		if c.Name == cfg.CurrentContext {
+			clusterName, userName, namespace = c.Context.Cluster, c.Context.User, c.Context.Namespace
+			found = true
+		}
+	}
+	if !found {
+		return nil, errors.New("Context " + cfg.CurrentContext + " not found in " + path)
+	}
+	if namespace == "" {
+		namespace = KUBERNETES_DEFAULT_NAMESPACE
+	}
+
+	tlsConfig := &tls.Config{}
+	server := ""
+	for _, c := range cfg.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		server = c.Cluster.Server
+		tlsConfig.InsecureSkipVerify = c.Cluster.InsecureSkipTlsVerify
+		ca, err := kubeconfigData(c.Cluster.CertificateAuthorityData, resolve(c.Cluster.CertificateAuthority))
+		if err != nil {
+			return nil, err
+		}
+		if ca != nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, errors.New("Bad certificate authority of cluster " + clusterName)
+			}
+		}
+	}
+	if server == "" {
+		return nil, errors.New("Cluster " + clusterName + " not found in " + path)
+	}
+
+	token, tokenFile := "", ""
+	for _, u := range cfg.Users {
+		if u.Name != userName {
+			continue
+		}
+		token = u.User.Token
+		if u.User.TokenFile != "" {
+			tokenFile = resolve(u.User.TokenFile)
+			t, err := ioutil.ReadFile(tokenFile)
+			if err != nil {
+				return nil, err
+			}
+			token = strings.TrimSpace(string(t))
+		}
+		cert, err := kubeconfigData(u.User.ClientCertificateData, resolve(u.User.ClientCertificate))
+		if err != nil {
+			return nil, err
+		}
+		key, err := kubeconfigData(u.User.ClientKeyData, resolve(u.User.ClientKey))
+		if err != nil {
+			return nil, err
+		}
+		if cert != nil && key != nil {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+	}
+
+	api := newKubeApiWithTls(strings.TrimSuffix(server, "/"), token, namespace, tlsConfig)
+	api.tokenFile = tokenFile
+
+	return api, nil
+}
+
+/**
+ * Inline base64 data or file contents, nil if none given
+ */
+func kubeconfigData(data string, file string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file != "" {
+		return ioutil.ReadFile(file)
+	}
+	return nil, nil
+}
+
+func newKubeApiWithTls(server string, token string, namespace string, tlsConfig *tls.Config) *kubeApi {
+
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+	}
+
+	return &kubeApi{
+		server:      server,
+		token:       token,
+		namespace:   namespace,
+		client:      &http.Client{Transport: transport, Timeout: KUBERNETES_REQUEST_TIMEOUT},
+		watchClient: &http.Client{Transport: transport},
+	}
+}
+
+/**
+ * Do GET request to api server path
+ */
+func (this *kubeApi) get(ctx context.Context, client *http.Client, path string) (*http.Response, error) {
+
+	req, err := http.NewRequestWithContext(ctx, "GET", this.server+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	if token := this.currentToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &kubeStatusError{resp.StatusCode, "Unexpected status " + resp.Status + " from " + path}
+	}
+
+	return resp, nil
+}
+
+/**
+ * Token from token file, or last known one if file can't be read
+ */
+func (this *kubeApi) currentToken() string {
+	if this.tokenFile == "" {
+		return this.token
+	}
+	if t, err := ioutil.ReadFile(this.tokenFile); err == nil {
+		this.token = strings.TrimSpace(string(t))
+	}
+	return this.token
+}
+
+/**
+ * Non OK response of api server
+ */
+type kubeStatusError struct {
+	code    int
+	message string
+}
+
+func (this *kubeStatusError) Error() string {
+	return this.message
+}
@@ -0,0 +1,366 @@
+/**
+ * kubernetes.go - kubernetes EndpointSlice discovery implementation
+ */
+
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"../config"
+	"../core"
+	"../logging"
+)
+
+const (
+	KUBERNETES_DEFAULT_RETRY_WAIT = 5 * time.Second
+	KUBERNETES_WATCH_TIMEOUT      = 5 * time.Minute
+	KUBERNETES_SERVICE_NAME_LABEL = "kubernetes.io/service-name"
+)
+
+/**
+ * EndpointSlice, discovery.k8s.io/v1
+ */
+type endpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready       *bool `json:"ready"`
+			Serving     *bool `json:"serving"`
+			Terminating *bool `json:"terminating"`
+		} `json:"conditions"`
+		NodeName string `json:"nodeName"`
+		Zone     string `json:"zone"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name *string `json:"name"`
+		Port *int    `json:"port"`
+	} `json:"ports"`
+}
+
+type endpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []endpointSlice `json:"items"`
+}
+
+type kubeWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+/**
+ * Kubernetes watcher state, used only from discovery goroutine
+ */
+type kubeWatcher struct {
+	cfg config.KubernetesDiscoveryConfig
+	api *kubeApi
+
+	/* Current slices of service by name */
+	slices          map[string]*endpointSlice
+	resourceVersion string
+	listed          bool
+
+	/* Current watch stream, nil if not watching */
+	stream  io.ReadCloser
+	decoder *json.Decoder
+
+	/* Cancels requests on stop */
+	ctx    context.Context
+	cancel func()
+}
+
+/**
+ * Creates new kubernetes discovery
+ */
+func NewKubernetesDiscovery(cfg config.DiscoveryConfig) interface{} {
+
+	kubeCfg := config.KubernetesDiscoveryConfig{}
+	if cfg.KubernetesDiscoveryConfig != nil {
+		kubeCfg = *cfg.KubernetesDiscoveryConfig
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	w := &kubeWatcher{
+		cfg:    kubeCfg,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	d := Discovery{
+		opts:  DiscoveryOpts{KUBERNETES_DEFAULT_RETRY_WAIT},
+		cfg:   cfg,
+		fetch: w.fetch,
+		// fetch itself blocks on watch until slices change
+		wait:   func(stop <-chan bool) {},
+		cancel: w.cancel,
+	}
+
+	return &d
+}
+
+/**
+ * List slices on first call, then block on watch until they change
+ */
+func (this *kubeWatcher) fetch(cfg config.DiscoveryConfig) (*[]core.Backend, error) {
+
+	if this.cfg.KubernetesService == "" {
+		return nil, errors.New("kubernetes_service is not set")
+	}
+
+	if this.api == nil {
+		api, err := newKubeApi(this.cfg.KubernetesKubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		if this.cfg.KubernetesNamespace != "" {
+			api.namespace = this.cfg.KubernetesNamespace
+		}
+		this.api = api
+	}
+
+	if !this.listed {
+		if err := this.list(); err != nil {
+			return nil, err
+		}
+		return this.backends(), nil
+	}
+
+	for {
+		if this.decoder == nil {
+			if err := this.watch(); err != nil {
+				return nil, err
+			}
+		}
+
+		var event kubeWatchEvent
+		if err := this.decoder.Decode(&event); err != nil {
+			this.closeWatch()
+			// server closes watch on timeout, just watch again
+			if err == io.EOF {
+				continue
+			}
+			return nil, err
+		}
+
+		switch event.Type {
+
+		case "ADDED", "MODIFIED", "DELETED":
+			var slice endpointSlice
+			if err := json.Unmarshal(event.Object, &slice); err != nil {
+				return nil, err
+			}
+			this.resourceVersion = slice.Metadata.ResourceVersion
+			if event.Type == "DELETED" {
+				delete(this.slices, slice.Metadata.Name)
+			} else {
+				this.slices[slice.Metadata.Name] = &slice
+			}
+			return this.backends(), nil
+
+		case "BOOKMARK":
+			var slice endpointSlice
+			if err := json.Unmarshal(event.Object, &slice); err == nil {
+				this.resourceVersion = slice.Metadata.ResourceVersion
+			}
+
+		case "ERROR":
+			this.closeWatch()
+			var status struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			json.Unmarshal(event.Object, &status)
+			// resource version is too old, list again
+			if status.Code == http.StatusGone {
+				this.listed = false
+				if err := this.list(); err != nil {
+					return nil, err
+				}
+				return this.backends(), nil
+			}
+			return nil, errors.New("Watch error: " + status.Message)
+		}
+	}
+}
+
+/**
+ * Path of service endpoint slices
+ */
+func (this *kubeWatcher) path(query url.Values) string {
+	query.Set("labelSelector", KUBERNETES_SERVICE_NAME_LABEL+"="+this.cfg.KubernetesService)
+	return "/apis/discovery.k8s.io/v1/namespaces/" + url.PathEscape(this.api.namespace) + "/endpointslices?" + query.Encode()
+}
+
+/**
+ * List current slices of service
+ */
+func (this *kubeWatcher) list() error {
+
+	resp, err := this.api.get(this.ctx, this.api.client, this.path(url.Values{}))
+	if err != nil {
+		this.checkUnauthorized(err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	var list endpointSliceList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return err
+	}
+
+	this.slices = make(map[string]*endpointSlice)
+	for i := range list.Items {
+		this.slices[list.Items[i].Metadata.Name] = &list.Items[i]
+	}
+	this.resourceVersion = list.Metadata.ResourceVersion
+	this.listed = true
+
+	return nil
+}
+
+/**
+ * Start watching slices from last resource version
+ */
+func (this *kubeWatcher) watch() error {
+
+	query := url.Values{}
+	query.Set("watch", "1")
+	query.Set("allowWatchBookmarks", "true")
+	query.Set("resourceVersion", this.resourceVersion)
+	query.Set("timeoutSeconds", strconv.Itoa(int(KUBERNETES_WATCH_TIMEOUT/time.Second)))
+
+	resp, err := this.api.get(this.ctx, this.api.watchClient, this.path(query))
+	if err != nil {
+		this.checkUnauthorized(err)
+		// resource version is too old, list again on next fetch
+		if status, ok := err.(*kubeStatusError); ok && status.code == http.StatusGone {
+			this.listed = false
+		}
+		return err
+	}
+
+	this.stream = resp.Body
+	this.decoder = json.NewDecoder(resp.Body)
+
+	return nil
+}
+
+/**
+ * Connect again on next fetch if credentials are rejected,
+ * e.g. kubeconfig was updated with new ones
+ */
+func (this *kubeWatcher) checkUnauthorized(err error) {
+	if status, ok := err.(*kubeStatusError); ok && status.code == http.StatusUnauthorized {
+		this.api = nil
+	}
+}
+
+func (this *kubeWatcher) closeWatch() {
+	if this.stream != nil {
+		this.stream.Close()
+	}
+	this.stream = nil
+	this.decoder = nil
+}
+
+/**
+ * Backends from ready endpoints of slices, terminating
+ * endpoints still serving are draining
+ */
+func (this *kubeWatcher) backends() *[]core.Backend {
+
+	log := logging.For("discovery/kubernetes")
+
+	byTarget := map[core.Target]core.Backend{}
+
+	for _, slice := range this.slices {
+
+		port := 0
+		for _, p := range slice.Ports {
+			name := ""
+			if p.Name != nil {
+				name = *p.Name
+			}
+			if p.Port != nil && (this.cfg.KubernetesPortName == "" || name == this.cfg.KubernetesPortName) {
+				port = *p.Port
+				break
+			}
+		}
+		if port == 0 {
+			log.Debug("No port ", this.cfg.KubernetesPortName, " in slice ", slice.Metadata.Name)
+			continue
+		}
+
+		for _, e := range slice.Endpoints {
+			c := e.Conditions
+			ready := c.Ready == nil || *c.Ready
+			serving := ready
+			if c.Serving != nil {
+				serving = *c.Serving
+			}
+			terminating := c.Terminating != nil && *c.Terminating
+
+			draining := false
+			switch {
+			case ready && !terminating:
+			case serving && terminating:
+				draining = true
+			default:
+				continue
+			}
+
+			labels := map[string]string{}
+			if e.Zone != "" {
+				labels["zone"] = e.Zone
+			}
+			if e.NodeName != "" {
+				labels["node"] = e.NodeName
+			}
+
+			for _, address := range e.Addresses {
+				backend := core.Backend{
+					Target: core.Target{
+						Host: address,
+						Port: strconv.Itoa(port),
+					},
+					Priority: 1,
+					Weight:   1,
+					Draining: draining,
+				}
+				backend.Labels = validLabels("kubernetes", backend.Target, labels)
+				backend.Stats.Live = true
+
+				// same endpoint may be in two slices while they are updated
+				if existing, ok := byTarget[backend.Target]; ok && !existing.Draining {
+					continue
+				}
+				byTarget[backend.Target] = backend
+			}
+		}
+	}
+
+	backends := make([]core.Backend, 0, len(byTarget))
+	for _, b := range byTarget {
+		backends = append(backends, b)
+	}
+	sort.Slice(backends, func(i, j int) bool {
+		return backends[i].Target.String() < backends[j].Target.String()
+	})
+
+	return &backends
+}
@@ -0,0 +1,224 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"../config"
+	"../core"
+)
+
+/**
+ * Fake api server, answers list requests with current list
+ * and watch requests with queued streams of events
+ */
+type fakeKubeApi struct {
+	t     *testing.T
+	mutex sync.Mutex
+
+	list    string
+	watches []string
+
+	/* Resource versions of watch requests */
+	watched []string
+	lists   int
+	tokens  []string
+}
+
+func (this *fakeKubeApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/default/endpointslices" {
+		this.t.Errorf("unexpected path %s", r.URL.Path)
+	}
+	if selector := r.URL.Query().Get("labelSelector"); selector != KUBERNETES_SERVICE_NAME_LABEL+"=svc" {
+		this.t.Errorf("unexpected selector %s", selector)
+	}
+	this.tokens = append(this.tokens, r.Header.Get("Authorization"))
+
+	if r.URL.Query().Get("watch") == "" {
+		this.lists++
+		fmt.Fprint(w, this.list)
+		return
+	}
+
+	this.watched = append(this.watched, r.URL.Query().Get("resourceVersion"))
+	if len(this.watches) == 0 {
+		// nothing more to tell, client should not watch again in test
+		this.t.Errorf("unexpected watch from %s", r.URL.Query().Get("resourceVersion"))
+		return
+	}
+	fmt.Fprint(w, this.watches[0])
+	this.watches = this.watches[1:]
+}
+
+func kubeSlice(name string, version string, endpoints ...string) string {
+	return `{"metadata":{"name":"` + name + `","resourceVersion":"` + version + `"},` +
+		`"endpoints":[` + strings.Join(endpoints, ",") + `],` +
+		`"ports":[{"name":"tun","port":4000},{"name":"other","port":5000}]}`
+}
+
+func kubeEndpoint(address string, conditions string) string {
+	return `{"addresses":["` + address + `"],"conditions":{` + conditions + `},"zone":"a","nodeName":"n1"}`
+}
+
+func kubeEvent(kind string, object string) string {
+	return `{"type":"` + kind + `","object":` + object + "}\n"
+}
+
+func newTestKubeWatcher(server string) *kubeWatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &kubeWatcher{
+		cfg: config.KubernetesDiscoveryConfig{
+			KubernetesService:  "svc",
+			KubernetesPortName: "tun",
+		},
+		api:    newKubeApiWithTls(server, "token", "default", nil),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func fetchTargets(t *testing.T, w *kubeWatcher) map[string]core.Backend {
+	backends, err := w.fetch(config.DiscoveryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := map[string]core.Backend{}
+	for _, b := range *backends {
+		result[b.Target.String()] = b
+	}
+	return result
+}
+
+func TestKubernetesListAndWatch(t *testing.T) {
+
+	api := &fakeKubeApi{t: t}
+	api.list = `{"metadata":{"resourceVersion":"10"},"items":[` + kubeSlice("s1", "9",
+		kubeEndpoint("10.0.0.1", `"ready":true`),
+		kubeEndpoint("10.0.0.2", `"ready":false,"serving":true,"terminating":true`),
+		kubeEndpoint("10.0.0.3", `"ready":false,"serving":false,"terminating":true`),
+		kubeEndpoint("10.0.0.4", `"ready":false`),
+	) + `]}`
+	api.watches = []string{
+		kubeEvent("BOOKMARK", `{"metadata":{"resourceVersion":"15"}}`) +
+			kubeEvent("MODIFIED", kubeSlice("s1", "16", kubeEndpoint("10.0.0.5", `"ready":true`))) +
+			kubeEvent("ERROR", `{"code":410,"message":"too old resource version"}`),
+		kubeEvent("DELETED", kubeSlice("s1", "21")),
+	}
+
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	w := newTestKubeWatcher(server.URL)
+	defer w.closeWatch()
+
+	// initial list: ready endpoint and draining one that is terminating but serving
+	targets := fetchTargets(t, w)
+	if len(targets) != 2 {
+		t.Fatalf("listed %v", targets)
+	}
+	if b := targets["10.0.0.1:4000"]; b.Draining || b.Labels["zone"] != "a" || b.Labels["node"] != "n1" {
+		t.Fatalf("ready backend %+v", b)
+	}
+	if b, ok := targets["10.0.0.2:4000"]; !ok || !b.Draining {
+		t.Fatalf("terminating serving backend %+v", b)
+	}
+
+	// bookmark is skipped, modification is returned
+	targets = fetchTargets(t, w)
+	if _, ok := targets["10.0.0.5:4000"]; !ok || len(targets) != 1 {
+		t.Fatalf("after modification %v", targets)
+	}
+	if w.resourceVersion != "16" {
+		t.Fatalf("resource version %s after modification", w.resourceVersion)
+	}
+
+	// 410 error lists again
+	api.mutex.Lock()
+	api.list = `{"metadata":{"resourceVersion":"20"},"items":[` + kubeSlice("s1", "20",
+		kubeEndpoint("10.0.0.9", `"ready":true`)) + `]}`
+	api.mutex.Unlock()
+
+	targets = fetchTargets(t, w)
+	if _, ok := targets["10.0.0.9:4000"]; !ok || len(targets) != 1 {
+		t.Fatalf("after relist %v", targets)
+	}
+
+	// watch continues from relisted version
+	targets = fetchTargets(t, w)
+	if len(targets) != 0 {
+		t.Fatalf("after delete %v", targets)
+	}
+
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	if api.lists != 2 {
+		t.Fatalf("listed %d times", api.lists)
+	}
+	if strings.Join(api.watched, ",") != "10,20" {
+		t.Fatalf("watched from %v", api.watched)
+	}
+}
+
+func TestKubernetesTokenRotation(t *testing.T) {
+
+	api := &fakeKubeApi{t: t, list: `{"metadata":{"resourceVersion":"1"},"items":[]}`}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "kube")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w := newTestKubeWatcher(server.URL)
+	w.api.tokenFile = tokenFile
+	if err := w.list(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(tokenFile, []byte("second\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.list(); err != nil {
+		t.Fatal(err)
+	}
+
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	if strings.Join(api.tokens, ",") != "Bearer first,Bearer second" {
+		t.Fatalf("tokens %v", api.tokens)
+	}
+}
+
+func TestKubernetesUnauthorized(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	w := newTestKubeWatcher(server.URL)
+	if err := w.list(); err == nil {
+		t.Fatal("expected error")
+	}
+	if w.api != nil {
+		t.Fatal("api is kept after 401")
+	}
+}
@@ -0,0 +1,175 @@
+/**
+ * multi.go - combining of multiple discoveries
+ */
+
+package discovery
+
+import (
+	"errors"
+
+	"../config"
+	"../core"
+	"../utils/labels"
+)
+
+/**
+ * Update of backends from one of sources
+ */
+type sourceUpdate struct {
+	index    int
+	backends []core.Backend
+}
+
+/**
+ * Multiple sources state, used only from discovery goroutine
+ * except for forwarding goroutines writing to updates
+ */
+type multiSource struct {
+	sources    []*Discovery
+	precedence []int
+
+	/* Last backends of every source, nil if not received yet */
+	lists [][]core.Backend
+
+	updates chan sourceUpdate
+	done    chan bool
+	started bool
+}
+
+/**
+ * Creates discovery merging backends of several sources by target.
+ * When target is discovered by more than one source, backend of source
+ * with higher precedence wins, or of the first one when equal
+ */
+func NewMulti(cfgs []config.DiscoveryConfig) *Discovery {
+
+	m := &multiSource{
+		lists:   make([][]core.Backend, len(cfgs)),
+		updates: make(chan sourceUpdate),
+		done:    make(chan bool),
+	}
+
+	for _, cfg := range cfgs {
+		m.sources = append(m.sources, New(cfg.Kind, cfg))
+		m.precedence = append(m.precedence, cfg.Precedence)
+	}
+
+	d := Discovery{
+		opts:   DiscoveryOpts{0},
+		cfg:    config.DiscoveryConfig{Kind: "multi"},
+		fetch:  m.fetch,
+		wait:   m.wait,
+		cancel: m.stop,
+	}
+
+	return &d
+}
+
+/**
+ * Merged backends of sources, waits for first update on first call
+ */
+func (this *multiSource) fetch(cfg config.DiscoveryConfig) (*[]core.Backend, error) {
+
+	if !this.started {
+		this.start()
+		if !this.receive(this.done) {
+			return nil, errors.New("Stopped")
+		}
+	}
+
+	return this.merge(), nil
+}
+
+/**
+ * Wait for next update of any source
+ */
+func (this *multiSource) wait(stop <-chan bool) {
+	this.receive(stop)
+}
+
+/**
+ * Receive update of source, returns false if stopped
+ */
+func (this *multiSource) receive(stop <-chan bool) bool {
+	select {
+	case u := <-this.updates:
+		this.lists[u.index] = u.backends
+		return true
+	case <-stop:
+		return false
+	case <-this.done:
+		return false
+	}
+}
+
+/**
+ * Start sources and forward their updates
+ */
+func (this *multiSource) start() {
+
+	this.started = true
+
+	for i, source := range this.sources {
+		source.Start()
+		go func(index int, source *Discovery) {
+			for {
+				select {
+				case backends := <-source.Discover():
+					select {
+					case this.updates <- sourceUpdate{index, backends}:
+					case <-this.done:
+						return
+					}
+				case <-this.done:
+					return
+				}
+			}
+		}(i, source)
+	}
+}
+
+/**
+ * Stop sources and forwarding
+ */
+func (this *multiSource) stop() {
+	close(this.done)
+	for _, source := range this.sources {
+		source.Stop()
+	}
+}
+
+/**
+ * Merge backends of sources by target
+ */
+func (this *multiSource) merge() *[]core.Backend {
+
+	backends := []core.Backend{}
+	owner := map[core.Target]int{}
+	position := map[core.Target]int{}
+
+	for i, list := range this.lists {
+		for _, b := range list {
+
+			pos, ok := position[b.Target]
+			if !ok {
+				position[b.Target] = len(backends)
+				owner[b.Target] = i
+				backends = append(backends, b)
+				continue
+			}
+
+			winner := backends[pos]
+			if this.precedence[i] > this.precedence[owner[b.Target]] {
+				winner = b
+				owner[b.Target] = i
+			}
+
+			// labels are merged, the winning source overrides the same keys
+			winner.Labels = labels.Merge(backends[pos].Labels, b.Labels, winner.Labels)
+			backends[pos] = winner
+		}
+	}
+
+	return &backends
+}
+
@@ -0,0 +1,286 @@
+/**
+ * resolve.go - resolving of backends hostnames into addresses
+ */
+
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"../config"
+	"../core"
+	"../logging"
+	"github.com/miekg/dns"
+)
+
+/**
+ * Resolved addresses of hostname
+ */
+type hostAddresses struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+/**
+ * Resolves hostnames of discovered backends, keeping
+ * addresses until their ttl expires.
+ * Used only from discovery goroutine
+ */
+type hostResolver struct {
+	server    string
+	client    *dns.Client
+	minTtl    time.Duration
+	retryWait time.Duration
+	hosts     map[string]*hostAddresses
+
+	/* Record types to query, A only by default */
+	qtypes []uint16
+}
+
+func newHostResolver(cfg config.DiscoveryConfig) *hostResolver {
+
+	log := logging.For("discovery/resolve")
+
+	families := cfg.ResolveFamilies
+	if len(families) == 0 {
+		families = []string{"a"}
+	}
+
+	qtypes := []uint16{}
+	for _, family := range families {
+		switch strings.ToLower(family) {
+		case "a":
+			qtypes = append(qtypes, dns.TypeA)
+		case "aaaa":
+			qtypes = append(qtypes, dns.TypeAAAA)
+		default:
+			log.Warn("Unknown resolve family ", family, ", skipping")
+		}
+	}
+	if len(qtypes) == 0 {
+		qtypes = []uint16{dns.TypeA}
+	}
+
+	return &hostResolver{
+		server:    cfg.Resolver,
+		client:    &dns.Client{Timeout: parseDurationOr(cfg.ResolveTimeout, DNS_DEFAULT_TIMEOUT)},
+		minTtl:    parseDurationOr(cfg.ResolveMinTtl, DNS_DEFAULT_MIN_TTL),
+		retryWait: DNS_DEFAULT_RETRY_WAIT,
+		hosts:     make(map[string]*hostAddresses),
+		qtypes:    qtypes,
+	}
+}
+
+/**
+ * Check if backend host needs resolving
+ */
+func isHostname(host string) bool {
+	return host != "" && !strings.Contains(host, ":") && net.ParseIP(host) == nil
+}
+
+/**
+ * Replace backends having hostname with backend per resolved address.
+ * Returns backends and time when addresses should be resolved again,
+ * zero if there are no hostnames
+ */
+func (this *hostResolver) expand(backends []core.Backend) ([]core.Backend, time.Time) {
+
+	log := logging.For("discovery/resolve")
+
+	result := []core.Backend{}
+	seen := map[core.Target]bool{}
+	used := map[string]bool{}
+	var next time.Time
+
+	for _, b := range backends {
+
+		if !isHostname(b.Target.Host) {
+			if !seen[b.Target] {
+				seen[b.Target] = true
+				result = append(result, b)
+			}
+			continue
+		}
+
+		hostname := b.Target.Host
+		used[hostname] = true
+
+		addrs := this.resolve(hostname)
+		if next.IsZero() || addrs.expires.Before(next) {
+			next = addrs.expires
+		}
+		if len(addrs.ips) == 0 {
+			log.Warn("No addresses of ", hostname, ", skipping backend")
+			continue
+		}
+
+		for _, ip := range addrs.ips {
+			resolved := b
+			resolved.Target.Host = ip.String()
+			resolved.Hostname = hostname
+			if seen[resolved.Target] {
+				continue
+			}
+			seen[resolved.Target] = true
+			result = append(result, resolved)
+		}
+	}
+
+	// forget hostnames no longer discovered
+	for hostname := range this.hosts {
+		if !used[hostname] {
+			delete(this.hosts, hostname)
+		}
+	}
+
+	return result, next
+}
+
+/**
+ * Cached addresses of hostname, resolving it again if expired.
+ * On error previous addresses are kept until retry
+ */
+func (this *hostResolver) resolve(hostname string) *hostAddresses {
+
+	log := logging.For("discovery/resolve")
+
+	now := time.Now()
+
+	cached, ok := this.hosts[hostname]
+	if ok && now.Before(cached.expires) {
+		return cached
+	}
+
+	ips, ttl, err := this.lookup(hostname)
+	if err != nil {
+		if !ok {
+			cached = &hostAddresses{}
+			this.hosts[hostname] = cached
+		}
+		cached.expires = now.Add(this.retryWait)
+		log.Error("Error resolving ", hostname, ": ", err, ", keeping ", cached.ips)
+		return cached
+	}
+
+	if ttl < this.minTtl {
+		ttl = this.minTtl
+	}
+
+	log.Debug("Resolved ", hostname, " to ", ips, ", ttl ", ttl)
+
+	addrs := &hostAddresses{ips: ips, expires: now.Add(ttl)}
+	this.hosts[hostname] = addrs
+
+	return addrs
+}
+
+/**
+ * Query records of configured families of hostname, falling back
+ * to system resolver for names dns doesn't know (e.g. /etc/hosts)
+ */
+func (this *hostResolver) lookup(hostname string) ([]net.IP, time.Duration, error) {
+
+	ips, ttl, err := this.query(hostname)
+	if err == nil && len(ips) > 0 {
+		return ips, ttl, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), this.client.Timeout)
+	defer cancel()
+
+	addrs, lookupErr := net.DefaultResolver.LookupIPAddr(ctx, hostname)
+	if lookupErr != nil {
+		if err == nil {
+			err = lookupErr
+		}
+		return nil, 0, err
+	}
+
+	ips = ips[:0]
+	for _, addr := range addrs {
+		if this.family(addr.IP) {
+			ips = append(ips, addr.IP)
+		}
+	}
+	sortIPs(ips)
+
+	return ips, this.minTtl, nil
+}
+
+/**
+ * Check if address is of configured family
+ */
+func (this *hostResolver) family(ip net.IP) bool {
+	qtype := dns.TypeAAAA
+	if ip.To4() != nil {
+		qtype = dns.TypeA
+	}
+	for _, t := range this.qtypes {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Query dns server for records of configured families, returns minimal ttl
+ */
+func (this *hostResolver) query(hostname string) ([]net.IP, time.Duration, error) {
+
+	server, err := nameserver(this.server)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ips := []net.IP{}
+	var ttl uint32
+	found := false
+
+	for _, qtype := range this.qtypes {
+
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(hostname), qtype)
+
+		in, err := exchange(this.client, msg, server)
+		if err != nil {
+			return nil, 0, err
+		}
+		if in.Rcode != dns.RcodeSuccess {
+			return nil, 0, errors.New("Error resolving " + hostname + ": " + dns.RcodeToString[in.Rcode])
+		}
+
+		// answer may contain cname chain, its ttls count too
+		for _, rr := range in.Answer {
+			switch record := rr.(type) {
+			case *dns.A:
+				ips = append(ips, record.A)
+			case *dns.AAAA:
+				ips = append(ips, record.AAAA)
+			case *dns.CNAME:
+			default:
+				continue
+			}
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+
+	// stable order, so that round robin answers are not seen as change
+	sortIPs(ips)
+
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+func sortIPs(ips []net.IP) {
+	sort.Slice(ips, func(i, j int) bool {
+		return ips[i].String() < ips[j].String()
+	})
+}
@@ -0,0 +1,42 @@
+package discovery
+
+import (
+	"testing"
+
+	"../config"
+	"../core"
+)
+
+func TestHostResolverFamilies(t *testing.T) {
+
+	server := newFakeDns(t)
+	defer server.close()
+
+	server.set(
+		"tun.example.com. 60 IN A 10.0.0.1",
+		"tun.example.com. 60 IN AAAA 2001:db8::1",
+	)
+	backends := []core.Backend{
+		{Target: core.Target{Host: "tun.example.com", Port: "4000"}},
+		{Target: core.Target{Host: "10.0.0.9", Port: "4000"}},
+	}
+
+	// A only by default
+	resolver := newHostResolver(config.DiscoveryConfig{Resolver: server.addr})
+	resolved, expires := resolver.expand(backends)
+	if len(resolved) != 2 || resolved[0].Target.String() != "10.0.0.1:4000" || resolved[0].Hostname != "tun.example.com" {
+		t.Fatalf("resolved %v", resolved)
+	}
+	if resolved[1].Target.String() != "10.0.0.9:4000" || resolved[1].Hostname != "" {
+		t.Fatalf("address backend %v", resolved[1])
+	}
+	if expires.IsZero() {
+		t.Fatal("no expiration of resolved addresses")
+	}
+
+	resolver = newHostResolver(config.DiscoveryConfig{Resolver: server.addr, ResolveFamilies: []string{"a", "aaaa"}})
+	resolved, _ = resolver.expand(backends)
+	if len(resolved) != 3 || resolved[0].Target.String() != "10.0.0.1:4000" || resolved[1].Target.String() != "[2001:db8::1]:4000" {
+		t.Fatalf("resolved both families %v", resolved)
+	}
+}
@@ -37,11 +37,11 @@ func staticFetch(cfg config.DiscoveryConfig) (*[]core.Backend, error) {
 	var backends []core.Backend
 	for _, s := range cfg.StaticList {
 		backend, err := parsers.ParseBackendDefault(s)
-		backend.Stats.Live = true
 		if err != nil {
 			log.Warn(err)
 			continue
 		}
+		backend.Stats.Live = true
 		backends = append(backends, *backend)
 	}
 
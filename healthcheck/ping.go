@@ -10,7 +10,7 @@ import (
 	"../config"
 	"../core"
 	"../logging"
-	"net"
+	"../utils/dial"
 	"time"
 )
 
@@ -28,12 +28,10 @@ func ping(t core.Target, cfg config.HealthcheckConfig, result chan<- CheckResult
 	}
 
 	buf := make([]byte, 20)
-	var conn *net.UDPConn
 	startT := time.Now()
-	tAddr, err := net.ResolveUDPAddr("udp", t.String())
+	log.Debug("connecting ", t.String())
+	conn, err := dial.UDP(t)
 	if nil == err {
-		log.Debug("connecting ", tAddr)
-		conn, err = net.DialUDP("udp", nil, tAddr);
 		defer conn.Close()
 	}
 	if err != nil {
@@ -0,0 +1,44 @@
+/**
+ * cookie.go - cookie challenge messages between clients and mptun
+ *
+ * reply (mptun to client):  | 3 | 0 | 0 | 0 | cookie (16) |
+ * echo (client to mptun):   | 5 | 0 | 0 | 0 | cookie (16) | original packet |
+ *
+ * Client challenged with cookie reply should prefix its packets with
+ * cookie echo until it gets replies from mptun.
+ */
+
+package protocol
+
+import (
+	"../utils/cookie"
+)
+
+const (
+	TYPE_COOKIE_REPLY = 3
+	TYPE_COOKIE_ECHO  = 5
+
+	COOKIE_HEADER_LEN = 4 + cookie.COOKIE_LEN
+)
+
+/**
+ * Build cookie reply message
+ */
+func CookieReply(c []byte) []byte {
+	message := make([]byte, COOKIE_HEADER_LEN)
+	message[0] = TYPE_COOKIE_REPLY
+	copy(message[4:], c)
+	return message
+}
+
+/**
+ * Parse cookie echo, returns cookie and original packet,
+ * ok is false if packet is not a cookie echo
+ */
+func ParseCookieEcho(packet []byte) ([]byte, []byte, bool) {
+	if len(packet) <= COOKIE_HEADER_LEN || packet[0] != TYPE_COOKIE_ECHO ||
+		packet[1] != 0 || packet[2] != 0 || packet[3] != 0 {
+		return nil, nil, false
+	}
+	return packet[4:COOKIE_HEADER_LEN], packet[COOKIE_HEADER_LEN:], true
+}
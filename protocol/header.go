@@ -0,0 +1,150 @@
+/**
+ * header.go - mptun encapsulation header
+ *
+ *  0                   1                   2                   3
+ *  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+ * +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ * |             Magic             |    Version    |     Flags     |
+ * +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ * |                        Flow (session) ID                      |
+ * +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ * |            Path ID            |           Reserved            |
+ * +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ * |                        Sequence Number                        |
+ * +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ * |                      Timestamp (millis)                       |
+ * +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ */
+
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"time"
+)
+
+const (
+	MAGIC      = 0x4d50
+	VERSION    = 1
+	HEADER_LEN = 20
+)
+
+/**
+ * Header flags
+ */
+const (
+	FLAG_FEC_PARITY = 1 << iota
+)
+
+var (
+	ErrShortPacket = errors.New("Packet is too short for mptun header")
+	ErrBadMagic    = errors.New("Bad mptun header magic")
+	ErrBadVersion  = errors.New("Unsupported mptun header version")
+)
+
+/**
+ * Encapsulation header
+ */
+type Header struct {
+	Version   uint8
+	Flags     uint8
+	FlowId    uint32
+	PathId    uint16
+	Seq       uint32
+	Timestamp uint32
+}
+
+/**
+ * Write header into first HEADER_LEN bytes of b
+ */
+func (h *Header) MarshalTo(b []byte) {
+	binary.BigEndian.PutUint16(b[0:2], MAGIC)
+	b[2] = h.Version
+	b[3] = h.Flags
+	binary.BigEndian.PutUint32(b[4:8], h.FlowId)
+	binary.BigEndian.PutUint16(b[8:10], h.PathId)
+	binary.BigEndian.PutUint16(b[10:12], 0)
+	binary.BigEndian.PutUint32(b[12:16], h.Seq)
+	binary.BigEndian.PutUint32(b[16:20], h.Timestamp)
+}
+
+/**
+ * Returns new packet with header prepended to payload
+ */
+func Encode(h *Header, payload []byte) []byte {
+	packet := make([]byte, HEADER_LEN+len(payload))
+	h.MarshalTo(packet)
+	copy(packet[HEADER_LEN:], payload)
+	return packet
+}
+
+/**
+ * Parse header of packet, returns header and payload
+ */
+func Decode(packet []byte) (*Header, []byte, error) {
+
+	if len(packet) < HEADER_LEN {
+		return nil, nil, ErrShortPacket
+	}
+
+	if binary.BigEndian.Uint16(packet[0:2]) != MAGIC {
+		return nil, nil, ErrBadMagic
+	}
+
+	h := &Header{
+		Version:   packet[2],
+		Flags:     packet[3],
+		FlowId:    binary.BigEndian.Uint32(packet[4:8]),
+		PathId:    binary.BigEndian.Uint16(packet[8:10]),
+		Seq:       binary.BigEndian.Uint32(packet[12:16]),
+		Timestamp: binary.BigEndian.Uint32(packet[16:20]),
+	}
+
+	if h.Version != VERSION {
+		return nil, nil, ErrBadVersion
+	}
+
+	return h, packet[HEADER_LEN:], nil
+}
+
+/**
+ * Flow id for key (i.e. client address or noise peer key),
+ * header goes to backends only and doesn't identify clients
+ */
+func FlowId(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+/**
+ * Path id for backend target
+ */
+func PathId(target string) uint16 {
+	id := FlowId(target)
+	return uint16(id>>16) ^ uint16(id)
+}
+
+/**
+ * Current timestamp in milliseconds, wraps around
+ */
+func Timestamp() uint32 {
+	return uint32(time.Now().UnixNano() / int64(time.Millisecond))
+}
+
+/**
+ * Extend 32 bit sequence number to 64 bit relative
+ * to last extended one, handling wrap around
+ */
+func Unwrap(last uint64, seq uint32) uint64 {
+	ext := (last &^ 0xffffffff) | uint64(seq)
+	diff := int32(seq - uint32(last))
+	if diff > 0 && ext < last {
+		ext += 1 << 32
+	} else if diff < 0 && ext > last && ext >= 1<<32 {
+		ext -= 1 << 32
+	}
+	return ext
+}
@@ -0,0 +1,78 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	h := &Header{
+		Version:   VERSION,
+		Flags:     FLAG_FEC_PARITY,
+		FlowId:    0xdeadbeef,
+		PathId:    0x1234,
+		Seq:       42,
+		Timestamp: 1000,
+	}
+
+	decoded, payload, err := Decode(Encode(h, []byte("payload")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *decoded != *h {
+		t.Fatalf("decoded %+v, want %+v", decoded, h)
+	}
+	if string(payload) != "payload" {
+		t.Fatalf("payload %q", payload)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	valid := Encode(&Header{Version: VERSION}, nil)
+
+	if _, _, err := Decode(valid[:HEADER_LEN-1]); err != ErrShortPacket {
+		t.Fatalf("short packet: %v", err)
+	}
+
+	badMagic := append([]byte{}, valid...)
+	badMagic[0] ^= 0xff
+	if _, _, err := Decode(badMagic); err != ErrBadMagic {
+		t.Fatalf("bad magic: %v", err)
+	}
+
+	badVersion := append([]byte{}, valid...)
+	badVersion[2] = VERSION + 1
+	if _, _, err := Decode(badVersion); err != ErrBadVersion {
+		t.Fatalf("bad version: %v", err)
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	f.Add(Encode(&Header{Version: VERSION, FlowId: 1, PathId: 2, Seq: 3, Timestamp: 4}, []byte("data")))
+	f.Add(Encode(&Header{Version: VERSION, Flags: FLAG_FEC_PARITY, Seq: 0xffffffff}, nil))
+	f.Add([]byte{})
+	f.Add([]byte{0x4d, 0x50, VERSION})
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		h, payload, err := Decode(packet)
+		if err != nil {
+			return
+		}
+
+		// decoded header marshals back to the same bytes, except reserved field
+		encoded := Encode(h, payload)
+		expected := append([]byte{}, packet...)
+		expected[10], expected[11] = 0, 0
+		if !bytes.Equal(encoded, expected) {
+			t.Fatalf("round trip of %x gives %x", packet, encoded)
+		}
+
+		again, againPayload, err := Decode(encoded)
+		if err != nil {
+			t.Fatalf("decoding encoded header: %v", err)
+		}
+		if *again != *h || !bytes.Equal(againPayload, payload) {
+			t.Fatalf("decoded %+v, want %+v", again, h)
+		}
+	})
+}
@@ -0,0 +1,295 @@
+/**
+ * qos.go - egress priority queues keyed by inner DSCP
+ */
+
+package qos
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"../config"
+)
+
+const (
+	SCHEDULER_STRICT = "strict"
+	SCHEDULER_WFQ    = "wfq"
+
+	DEFAULT_DEPTH  = 256
+	DEFAULT_WEIGHT = 1
+
+	/* Deficit round robin quantum in bytes, per weight unit */
+	QUANTUM = 1600
+)
+
+/**
+ * Queue item, send is called when item is dequeued
+ */
+type item struct {
+	size int
+	send func()
+}
+
+/**
+ * Traffic class with its own fifo
+ */
+type class struct {
+	name   string
+	weight int
+	depth  int
+
+	items   []item
+	deficit int
+
+	enqueued uint64
+	sent     uint64
+	dropped  uint64
+}
+
+/**
+ * Class counters
+ */
+type ClassStats struct {
+	Depth    int    `json:"depth"`
+	Enqueued uint64 `json:"enqueued"`
+	Sent     uint64 `json:"sent"`
+	Dropped  uint64 `json:"dropped"`
+}
+
+/**
+ * Compiled qos policy, creates queues
+ */
+type Policy struct {
+	strict  bool
+	classes []config.QosClass
+	byDscp  [64]int
+}
+
+/**
+ * Creates policy from configuration
+ */
+func NewPolicy(cfg config.QosConfig) (*Policy, error) {
+
+	p := &Policy{}
+
+	switch cfg.Scheduler {
+	case "", SCHEDULER_STRICT:
+		p.strict = true
+	case SCHEDULER_WFQ:
+		p.strict = false
+	default:
+		return nil, errors.New("Unknown qos scheduler " + cfg.Scheduler)
+	}
+
+	if len(cfg.Classes) == 0 {
+		return nil, errors.New("No qos classes configured")
+	}
+	p.classes = cfg.Classes
+
+	// unmapped dscp goes to default class, or the last one
+	defaultClass := len(p.classes) - 1
+	for i, c := range p.classes {
+		if c.Name == cfg.DefaultClass {
+			defaultClass = i
+		}
+	}
+	if cfg.DefaultClass != "" && p.classes[defaultClass].Name != cfg.DefaultClass {
+		return nil, errors.New("Unknown qos default class " + cfg.DefaultClass)
+	}
+
+	for i := range p.byDscp {
+		p.byDscp[i] = defaultClass
+	}
+	for i, c := range p.classes {
+		for _, dscp := range c.Dscp {
+			if dscp < 0 || dscp >= len(p.byDscp) {
+				return nil, errors.New("Bad dscp value in qos class " + c.Name)
+			}
+			p.byDscp[dscp] = i
+		}
+	}
+
+	return p, nil
+}
+
+/**
+ * Creates new started queue
+ */
+func (this *Policy) NewQueue() *Queue {
+	q := &Queue{
+		strict: this.strict,
+		byDscp: this.byDscp,
+	}
+	q.cond = sync.NewCond(&q.mutex)
+
+	for _, c := range this.classes {
+		cl := &class{
+			name:   c.Name,
+			weight: c.Weight,
+			depth:  c.Depth,
+		}
+		if cl.weight <= 0 {
+			cl.weight = DEFAULT_WEIGHT
+		}
+		if cl.depth <= 0 {
+			cl.depth = DEFAULT_DEPTH
+		}
+		q.classes = append(q.classes, cl)
+	}
+
+	go q.run()
+
+	return q
+}
+
+/**
+ * Egress queue
+ */
+type Queue struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+
+	strict  bool
+	classes []*class
+	byDscp  [64]int
+
+	/* Queued items count */
+	count int
+
+	/* Deficit round robin position */
+	next    int
+	visited bool
+
+	stopped bool
+}
+
+/**
+ * Enqueue send of size bytes in class of dscp
+ * Returns false if class queue is full and item is dropped
+ */
+func (this *Queue) Enqueue(dscp int, size int, send func()) bool {
+	c := this.classes[this.byDscp[dscp&0x3f]]
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.stopped {
+		return false
+	}
+
+	if len(c.items) >= c.depth {
+		atomic.AddUint64(&c.dropped, 1)
+		return false
+	}
+
+	c.items = append(c.items, item{size, send})
+	this.count++
+	atomic.AddUint64(&c.enqueued, 1)
+	this.cond.Signal()
+
+	return true
+}
+
+/**
+ * Stop queue dropping queued items
+ */
+func (this *Queue) Stop() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.stopped = true
+	for _, c := range this.classes {
+		c.items = nil
+	}
+	this.count = 0
+	this.cond.Broadcast()
+}
+
+/**
+ * Get counters by class name
+ */
+func (this *Queue) Stats() map[string]ClassStats {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	stats := make(map[string]ClassStats)
+	for _, c := range this.classes {
+		stats[c.name] = ClassStats{
+			Depth:    len(c.items),
+			Enqueued: atomic.LoadUint64(&c.enqueued),
+			Sent:     atomic.LoadUint64(&c.sent),
+			Dropped:  atomic.LoadUint64(&c.dropped),
+		}
+	}
+	return stats
+}
+
+/**
+ * Dequeue and send items until stopped
+ */
+func (this *Queue) run() {
+	for {
+		this.mutex.Lock()
+		for this.count == 0 && !this.stopped {
+			this.cond.Wait()
+		}
+		if this.stopped {
+			this.mutex.Unlock()
+			return
+		}
+
+		var c *class
+		if this.strict {
+			c = this.pickStrict()
+		} else {
+			c = this.pickWeighted()
+		}
+
+		it := c.items[0]
+		c.items[0] = item{}
+		c.items = c.items[1:]
+		if !this.strict {
+			c.deficit -= it.size
+		}
+		this.count--
+		this.mutex.Unlock()
+
+		it.send()
+		atomic.AddUint64(&c.sent, 1)
+	}
+}
+
+/**
+ * First non empty class in configuration order
+ */
+func (this *Queue) pickStrict() *class {
+	for _, c := range this.classes {
+		if len(c.items) > 0 {
+			return c
+		}
+	}
+	return nil
+}
+
+/**
+ * Deficit round robin over non empty classes
+ */
+func (this *Queue) pickWeighted() *class {
+	for {
+		c := this.classes[this.next]
+		if len(c.items) > 0 {
+			if !this.visited {
+				c.deficit += QUANTUM * c.weight
+				this.visited = true
+			}
+			if c.items[0].size <= c.deficit {
+				return c
+			}
+		} else {
+			c.deficit = 0
+		}
+		this.next = (this.next + 1) % len(this.classes)
+		this.visited = false
+	}
+}
@@ -29,6 +29,9 @@ type Scheduler struct {
 
 	electChan chan ElectRequest
 	LiveBackendsChan chan []core.Backend
+
+	/* Resolved addresses of hostnames that disappeared */
+	RemovedBackendsChan chan []core.Target
 }
 
 func (this *Scheduler) Start() {
@@ -41,14 +44,21 @@ func (this *Scheduler) Start() {
 	this.electChan = make(chan ElectRequest)
 	this.stopChan = make (chan bool)
 	this.LiveBackendsChan = make (chan []core.Backend)
+	this.RemovedBackendsChan = make (chan []core.Target)
 	backendsPushTicker := time.NewTicker( 5* time.Second)
 
 	go func() {
 		for {
 			select {
 			case backends := <-this.Discovery.Discover():
-				this.HandleBackendsUpdate(backends)
+				removed := this.HandleBackendsUpdate(backends)
 				this.Healthcheck.In <- this.Targets()
+				if len(removed) > 0 {
+					// push live backends first so that moved sessions
+					// don't go to removed addresses again
+					this.LiveBackendsChan <- this.LiveBackends()
+					this.RemovedBackendsChan <- removed
+				}
 			case checkResult := <-this.Healthcheck.Out:
 				this.HandleBackendLiveChange(checkResult.Target, checkResult.Live, checkResult.Rtt, checkResult.Loss)
 			case electReq := <-this.electChan:
@@ -70,7 +80,11 @@ func (this *Scheduler) Stop() {
 	this.stopChan <- true
 }
 
-func (this *Scheduler) HandleBackendsUpdate(backends []core.Backend) {
+/**
+ * Update backends from discovery, returns targets
+ * of resolved hostnames addresses that are gone
+ */
+func (this *Scheduler) HandleBackendsUpdate(backends []core.Backend) []core.Target {
 	updated := map[core.Target]*core.Backend{}
 	updatedList := make([]*core.Backend, len(backends))
 
@@ -88,8 +102,17 @@ func (this *Scheduler) HandleBackendsUpdate(backends []core.Backend) {
 		}
 	}
 
+	var removed []core.Target
+	for target, b := range this.backends {
+		if _, ok := updated[target]; !ok && b.Hostname != "" {
+			removed = append(removed, target)
+		}
+	}
+
 	this.backends = updated
 	this.backendsList = updatedList
+
+	return removed
 }
 
 func (this *Scheduler) TakeBackend(context core.Context) (*core.Backend, error) {
@@ -112,7 +135,7 @@ func (this *Scheduler) HandleBackendElect(req ElectRequest) {
 	var backends []*core.Backend
 
 	for _, b := range this.backendsList {
-		if !b.Stats.Live {
+		if !b.Stats.Live || b.Draining {
 			continue
 		}
 		backends = append(backends, b)
@@ -153,13 +176,14 @@ func (this *Scheduler) Backends() []core.Backend {
 }
 
 /**
- * Return current live backends
+ * Return current live backends, draining ones
+ * are not taking new sessions and are skipped
  */
 func (this *Scheduler) LiveBackends() []core.Backend {
 	var backends []core.Backend
 
 	for _, b := range this.backends {
-		if !b.Stats.Live {
+		if !b.Stats.Live || b.Draining {
 			continue
 		}
 		backends = append(backends, *b)
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"../logging"
+	"../protocol"
+	"../utils/cookie"
+	"../utils/ratelimit"
+)
+
+var errRateLimited = errors.New("New sessions rate limit exceeded")
+
+/**
+ * Setup new clients admission from configuration
+ */
+func (this *Server) setupAdmission() error {
+	if this.cfg.NewSessionsRate > 0 {
+		this.newSessionsBucket = ratelimit.New(this.cfg.NewSessionsRate, this.cfg.NewSessionsBurst)
+	}
+
+	if this.cfg.Cookie != nil {
+		lifetime, err := parseOptionalDuration(this.cfg.Cookie.SecretLifetime)
+		if err != nil {
+			return err
+		}
+		this.cookies = cookie.New(lifetime, this.cfg.Cookie.LoadThreshold)
+	}
+
+	return nil
+}
+
+/**
+ * Check if client has a flow already
+ */
+func (this *Server) knownClient(clientAddr net.UDPAddr) bool {
+	this.clientsLock.RLock()
+	defer this.clientsLock.RUnlock()
+
+	return this.clients[clientAddr.String()]
+}
+
+/**
+ * Mark client as known or unknown, called when flows change
+ */
+func (this *Server) setKnownClient(clientAddr net.UDPAddr, known bool) {
+	this.clientsLock.Lock()
+	defer this.clientsLock.Unlock()
+
+	if known {
+		this.clients[clientAddr.String()] = true
+	} else {
+		delete(this.clients, clientAddr.String())
+	}
+}
+
+/**
+ * Admit packet from client before any per-session state is allocated
+ * Clients without flow may be challenged with cookie under load.
+ * Returns packet with cookie echo stripped and if it's admitted
+ */
+func (this *Server) admit(clientAddr net.UDPAddr, localIP net.IP, packet []byte) ([]byte, bool) {
+	log := logging.For("server/admission")
+
+	known := this.knownClient(clientAddr)
+
+	if this.cookies == nil {
+		return packet, true
+	}
+
+	// clients keep echoing cookie until they get replies,
+	// so echo is stripped for known clients too
+	c, original, ok := protocol.ParseCookieEcho(packet)
+	if ok && this.cookies.Valid(clientAddr.String(), c) {
+		if !known {
+			atomic.AddUint64(&this.admissionStats.CookiesAccepted, 1)
+		}
+		return original, true
+	}
+
+	if known {
+		return packet, true
+	}
+
+	// load token is taken only by packets without valid echo
+	if !this.cookies.Required() {
+		return packet, true
+	}
+
+	if ok {
+		atomic.AddUint64(&this.admissionStats.CookiesRejected, 1)
+	}
+	atomic.AddUint64(&this.admissionStats.CookiesSent, 1)
+	reply := protocol.CookieReply(this.cookies.Make(clientAddr.String()))
+	if err := this.serverConn.write(reply, &clientAddr, localIP); err != nil {
+		log.Debug("Error sending cookie to ", clientAddr.String(), ": ", err)
+	}
+	return nil, false
+}
+
+/**
+ * Check new sessions rate limit, should be called
+ * from server loop before session is created
+ */
+func (this *Server) allowNewSession() bool {
+	if this.newSessionsBucket != nil && !this.newSessionsBucket.Allow() {
+		atomic.AddUint64(&this.admissionStats.RateLimited, 1)
+		return false
+	}
+	return true
+}
+
+/**
+ * Parse duration, empty string is zero duration
+ */
+func parseOptionalDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
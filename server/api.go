@@ -0,0 +1,62 @@
+/**
+ * api.go - http endpoint exposing server stats as json
+ */
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"../logging"
+)
+
+/**
+ * Handler of stats endpoint
+ */
+func (this *Server) statsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(this.Stats())
+	})
+	return mux
+}
+
+/**
+ * Start serving stats on configured address, if any
+ */
+func (this *Server) startStats() error {
+	log := logging.For("server/api")
+
+	if this.cfg.StatsBind == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", this.cfg.StatsBind)
+	if err != nil {
+		return err
+	}
+
+	this.statsServer = &http.Server{Handler: this.statsHandler()}
+
+	go func() {
+		if err := this.statsServer.Serve(listener); err != http.ErrServerClosed {
+			log.Error("Error serving stats ", err)
+		}
+	}()
+
+	log.Info("Serving stats on ", listener.Addr())
+
+	return nil
+}
+
+func (this *Server) stopStats() {
+	if this.statsServer != nil {
+		this.statsServer.Close()
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"encoding/hex"
+	"net"
+
+	"../logging"
+)
+
+/**
+ * Connection key identifying client flow and its sessions.
+ * Plain and pre-shared key clients are identified by their address,
+ * noise ones by their static key, so they keep flows when their
+ * address changes or they handshake again.
+ *
+ * There is no connection id in the client leg: noise transport header
+ * already carries receiver index authenticated as associated data, and
+ * pre-shared key clients share one key, so an id authenticated with it
+ * could be forged by any other client to take over its flows
+ */
+func connectionKey(kind string, id []byte) string {
+	return kind + ":" + hex.EncodeToString(id)
+}
+
+/**
+ * Move flow to address of the latest authenticated packet of connection,
+ * should be called from server loop
+ */
+func (this *Server) migrateFlow(f *flow, clientAddr net.UDPAddr, localIP net.IP) {
+	previous, changed := f.migrate(clientAddr, localIP)
+	if !changed {
+		return
+	}
+
+	if previous.String() != clientAddr.String() {
+		logging.For("server").Info("Client ", f.key, " migrated from ", previous.String(), " to ", clientAddr.String())
+		this.setKnownClient(previous, false)
+		this.setKnownClient(clientAddr, true)
+	}
+}
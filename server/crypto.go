@@ -0,0 +1,260 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"../config"
+	"../core"
+	"../logging"
+	"../utils/aead"
+	"../utils/handshake"
+)
+
+/**
+ * Name of key used for backends without explicit key
+ */
+const DEFAULT_BACKEND_KEY = "default"
+
+/**
+ * Create cipher from crypto configuration
+ */
+func newCipher(cfg *config.CryptoConfig) (*aead.Cipher, error) {
+	key, err := aead.LoadKey(cfg.Key, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return aead.New(cfg.Cipher, key, cfg.ReplayWindow)
+}
+
+/**
+ * Setup listener and backend ciphers from configuration
+ */
+func (this *Server) setupCrypto() error {
+	if this.cfg.Crypto != nil && this.cfg.Noise != nil {
+		return errors.New("Only one of crypto and noise could be configured for listener")
+	}
+
+	if this.cfg.Noise != nil {
+		responder, err := newResponder(this.cfg.Noise)
+		if err != nil {
+			return err
+		}
+		this.responder = responder
+	}
+
+	if this.cfg.Crypto != nil {
+		cipher, err := newCipher(this.cfg.Crypto)
+		if err != nil {
+			return err
+		}
+		this.clientCipher = cipher
+	}
+
+	this.backendCiphers = make(map[string]*aead.Cipher)
+	for name, cfg := range this.cfg.Keys {
+		cipher, err := newCipher(cfg)
+		if err != nil {
+			return errors.New("Key " + name + ": " + err.Error())
+		}
+		this.backendCiphers[name] = cipher
+	}
+
+	return nil
+}
+
+/**
+ * Create noise handshake responder from configuration
+ */
+func newResponder(cfg *config.NoiseConfig) (*handshake.Responder, error) {
+	static, err := handshake.LoadPrivateKey(cfg.PrivateKey, cfg.PrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	authorized, err := handshake.LoadAuthorizedKeys(cfg.AuthorizedKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := handshake.Options{
+		RekeyAfterBytes: cfg.RekeyAfterBytes,
+		ReplayWindow: cfg.ReplayWindow,
+	}
+	if cfg.RekeyAfterTime != "" {
+		opts.RekeyAfterTime, err = time.ParseDuration(cfg.RekeyAfterTime)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.SessionTimeout != "" {
+		opts.SessionTimeout, err = time.ParseDuration(cfg.SessionTimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return handshake.NewResponder(static, authorized, opts), nil
+}
+
+/**
+ * Check if client leg is encrypted
+ */
+func (this *Server) clientCrypto() bool {
+	return this.clientCipher != nil || this.responder != nil
+}
+
+/**
+ * Get cipher for backend, nil if backend traffic is not encrypted
+ */
+func (this *Server) backendCipher(backend *core.Backend) (*aead.Cipher, error) {
+	if backend.Key == "" {
+		return this.backendCiphers[DEFAULT_BACKEND_KEY], nil
+	}
+
+	cipher, ok := this.backendCiphers[backend.Key]
+	if !ok {
+		return nil, errors.New("Unknown key " + backend.Key + " for backend " + backend.Target.String())
+	}
+
+	return cipher, nil
+}
+
+/**
+ * Get or create sending channel of client connection for listener cipher
+ */
+func (this *Server) clientChannel(key string) *aead.Channel {
+	this.channelsLock.Lock()
+	defer this.channelsLock.Unlock()
+
+	channel, ok := this.clientChannels[key]
+	if !ok {
+		channel = this.clientCipher.Channel()
+		this.clientChannels[key] = channel
+	}
+
+	return channel
+}
+
+/**
+ * Forget channel or noise session of client connection
+ */
+func (this *Server) removeClientChannel(key string) {
+	this.channelsLock.Lock()
+	defer this.channelsLock.Unlock()
+
+	delete(this.clientChannels, key)
+
+	if session, ok := this.noiseSessions[key]; ok {
+		this.responder.Remove(session)
+		delete(this.noiseSessions, key)
+	}
+}
+
+/**
+ * Get noise session of client connection
+ */
+func (this *Server) noiseSession(key string) *handshake.Session {
+	this.channelsLock.Lock()
+	defer this.channelsLock.Unlock()
+
+	return this.noiseSessions[key]
+}
+
+/**
+ * Set noise session of client connection, replacing previous one
+ */
+func (this *Server) setNoiseSession(key string, session *handshake.Session) {
+	this.channelsLock.Lock()
+	defer this.channelsLock.Unlock()
+
+	if previous, ok := this.noiseSessions[key]; ok {
+		this.responder.Remove(previous)
+	}
+	this.noiseSessions[key] = session
+}
+
+/**
+ * Returns function encrypting packets to client connection, nil if client leg is not encrypted
+ */
+func (this *Server) clientSealer(key string) func([]byte) []byte {
+	if this.clientCipher != nil {
+		return this.clientChannel(key).Seal
+	}
+
+	if this.responder != nil {
+		return func(packet []byte) []byte {
+			session := this.noiseSession(key)
+			if session == nil {
+				return nil
+			}
+			return session.Seal(packet)
+		}
+	}
+
+	return nil
+}
+
+/**
+ * Decrypt packet from client, checking for replays
+ * Returns plaintext and connection key of client, plaintext is nil
+ * if packet was handshake message and is handled
+ */
+func (this *Server) openClientPacket(clientAddr net.UDPAddr, localIP net.IP, packet []byte) ([]byte, string, error) {
+	if this.responder != nil {
+		return this.openNoisePacket(clientAddr, localIP, packet)
+	}
+
+	plaintext, err := this.clientCipher.Open(packet)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// all clients share pre-shared key and could forge each other's
+	// channel id, so they are identified by address and can't roam
+	key := clientAddr.String()
+
+	return plaintext, key, nil
+}
+
+/**
+ * Handle noise handshake or transport message from client
+ */
+func (this *Server) openNoisePacket(clientAddr net.UDPAddr, localIP net.IP, packet []byte) ([]byte, string, error) {
+	log := logging.For("server")
+
+	switch handshake.Type(packet) {
+
+	case handshake.TYPE_INITIATION:
+		response, session, err := this.responder.Handshake(packet)
+		if err != nil {
+			atomic.AddUint64(&this.noiseStats.HandshakeFailures, 1)
+			return nil, "", err
+		}
+		atomic.AddUint64(&this.noiseStats.Handshakes, 1)
+		log.Info("Noise handshake with '", session.Peer, "' from ", clientAddr.String())
+		// replaces and forgets previous session of the same peer
+		this.setNoiseSession(connectionKey("noise", []byte(session.PeerKey)), session)
+		return nil, "", this.serverConn.write(response, &clientAddr, localIP)
+
+	case handshake.TYPE_TRANSPORT:
+		session, plaintext, err := this.responder.Open(packet)
+		if err != nil {
+			atomic.AddUint64(&this.noiseStats.AuthFailures, 1)
+			return nil, "", err
+		}
+		// session is authenticated by peer static key, client may send from any address
+		key := connectionKey("noise", []byte(session.PeerKey))
+		if this.noiseSession(key) != session {
+			atomic.AddUint64(&this.noiseStats.AuthFailures, 1)
+			return nil, "", handshake.ErrUnknownSession
+		}
+		return plaintext, key, nil
+
+	default:
+		atomic.AddUint64(&this.noiseStats.AuthFailures, 1)
+		return nil, "", errors.New("Unexpected noise message type")
+	}
+}
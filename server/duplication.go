@@ -0,0 +1,98 @@
+package server
+
+import (
+	"errors"
+
+	"golang.org/x/net/ipv4"
+
+	"../config"
+	"../utils/packet"
+)
+
+/**
+ * Default number of copies of matched packets
+ */
+const DEFAULT_DUPLICATION_COPIES = 2
+
+/**
+ * Default size of replies deduplication window
+ */
+const DEFAULT_DEDUP_WINDOW = 1024
+
+/**
+ * Compiled duplication rule
+ */
+type duplicationRule struct {
+	copies  int
+	matcher packet.Matcher
+	minSize int
+	maxSize int
+}
+
+/**
+ * Duplication policy, decides over how many paths
+ * packet should be sent
+ */
+type duplication struct {
+	rules []duplicationRule
+}
+
+func newDuplication(cfg config.DuplicationConfig) (*duplication, error) {
+	d := &duplication{}
+
+	copies := cfg.Copies
+	if copies <= 0 {
+		copies = DEFAULT_DUPLICATION_COPIES
+	}
+
+	for _, r := range cfg.Rules {
+		rule := duplicationRule{
+			copies: r.Copies,
+			matcher: packet.Matcher{
+				Protocol: -1,
+				Dscp:     packet.IntSet(r.Dscp),
+				Ports:    packet.IntSet(r.Ports),
+			},
+			minSize: r.MinSize,
+			maxSize: r.MaxSize,
+		}
+		if rule.copies <= 0 {
+			rule.copies = copies
+		}
+		if r.Protocol != "" {
+			if rule.matcher.Protocol = packet.Protocol(r.Protocol); rule.matcher.Protocol == -1 {
+				return nil, errors.New("Unknown duplication protocol " + r.Protocol)
+			}
+		}
+		d.rules = append(d.rules, rule)
+	}
+
+	return d, nil
+}
+
+/**
+ * Number of paths packet should be sent over, 1 if no rule matched
+ */
+func (d *duplication) copies(header *ipv4.Header, buf []byte) int {
+	if d == nil || header == nil {
+		return 1
+	}
+
+	for _, rule := range d.rules {
+		if rule.match(header, buf) {
+			return rule.copies
+		}
+	}
+
+	return 1
+}
+
+func (r *duplicationRule) match(header *ipv4.Header, buf []byte) bool {
+	if r.minSize > 0 && len(buf) < r.minSize {
+		return false
+	}
+	if r.maxSize > 0 && len(buf) > r.maxSize {
+		return false
+	}
+	return r.matcher.Match(header, buf, false)
+}
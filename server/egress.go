@@ -0,0 +1,86 @@
+package server
+
+import (
+	"../core"
+	"../logging"
+	"../qos"
+)
+
+/**
+ * Get or create egress queue of backend, nil if qos is disabled.
+ * Queue only builds up when dequeue is paced by egress rate,
+ * so backends without rate are sent to without queue
+ */
+func (this *Server) backendQueue(backend *core.Backend) *qos.Queue {
+	if this.qos == nil {
+		return nil
+	}
+
+	this.queuesLock.Lock()
+	defer this.queuesLock.Unlock()
+
+	if this.backendRate(backend) == 0 {
+		if !this.unpacedBackends[backend.Target] {
+			logging.For("server/egress").Warn("Qos disabled for backend ", backend.Target.String(), " without rate, set rate option or qos rate")
+			this.unpacedBackends[backend.Target] = true
+		}
+		return nil
+	}
+	delete(this.unpacedBackends, backend.Target)
+
+	q, ok := this.backendQueues[backend.Target]
+	if !ok {
+		q = this.qos.NewQueue()
+		this.backendQueues[backend.Target] = q
+	}
+
+	return q
+}
+
+/**
+ * Stop all egress queues
+ */
+func (this *Server) stopQueues() {
+	this.queuesLock.Lock()
+	defer this.queuesLock.Unlock()
+
+	for target, q := range this.backendQueues {
+		q.Stop()
+		delete(this.backendQueues, target)
+	}
+}
+
+/**
+ * Stop egress queues of backends not in use, should be called
+ * from server loop with targets of live backends and sessions
+ */
+func (this *Server) stopUnusedQueues(used map[core.Target]bool) {
+	this.queuesLock.Lock()
+	defer this.queuesLock.Unlock()
+
+	for target, q := range this.backendQueues {
+		if !used[target] {
+			q.Stop()
+			delete(this.backendQueues, target)
+		}
+	}
+	for target := range this.unpacedBackends {
+		if !used[target] {
+			delete(this.unpacedBackends, target)
+		}
+	}
+}
+
+/**
+ * Egress queues counters by backend and class
+ */
+func (this *Server) qosStats() map[string]map[string]qos.ClassStats {
+	this.queuesLock.Lock()
+	defer this.queuesLock.Unlock()
+
+	stats := make(map[string]map[string]qos.ClassStats)
+	for target, q := range this.backendQueues {
+		stats[target.String()] = q.Stats()
+	}
+	return stats
+}
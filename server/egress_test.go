@@ -0,0 +1,50 @@
+package server
+
+import (
+	"testing"
+
+	"../config"
+	"../core"
+	"../qos"
+)
+
+func TestBackendQueueNeedsRate(t *testing.T) {
+	policy, err := qos.NewPolicy(config.QosConfig{Classes: []config.QosClass{{Name: "default"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	this := &Server{
+		qos:             policy,
+		backendQueues:   make(map[core.Target]*qos.Queue),
+		unpacedBackends: make(map[core.Target]bool),
+		backendLimiters: make(map[core.Target]*limiter),
+		shapingBurst:    DEFAULT_SHAPING_BURST,
+	}
+	defer this.stopQueues()
+
+	backend := &core.Backend{Target: core.Target{Host: "127.0.0.1", Port: "4000"}}
+
+	// queue would be dequeued immediately without pacing
+	if this.backendQueue(backend) != nil || this.backendLimiter(backend) != nil {
+		t.Fatal("backend without rate has queue or limiter")
+	}
+	if !this.unpacedBackends[backend.Target] {
+		t.Fatal("backend without rate is not reported")
+	}
+
+	this.qosRate = 1000
+	if this.backendQueue(backend) == nil {
+		t.Fatal("backend paced by qos rate has no queue")
+	}
+	if l := this.backendLimiter(backend); l == nil || l.bytesRate != 1000 {
+		t.Fatal("backend is not paced by qos rate")
+	}
+	if this.unpacedBackends[backend.Target] {
+		t.Fatal("paced backend is reported")
+	}
+
+	backend.Rate = 2000
+	if l := this.backendLimiter(backend); l.bytesRate != 2000 {
+		t.Fatalf("backend rate is not preferred, rate %v", l.bytesRate)
+	}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"../protocol"
+	"../utils/ecn"
+	"../utils/fec"
+	"../utils/mss"
+	"../utils/reorder"
+	"../utils/window"
+)
+
+/**
+ * Flow of a client, shared by all its sessions (paths)
+ */
+type flow struct {
+	sync.Mutex
+
+	id uint32
+	serverConn *socket
+
+	/* Connection key of client */
+	key string
+
+	/* Current client address, changes when client roams */
+	clientAddr net.UDPAddr
+
+	/* Local address client sends to, nil if unknown */
+	localIP net.IP
+
+	/* Last sequence number sent to backends */
+	seq uint32
+
+	/* Reorder buffer of replies, nil if disabled */
+	reorder *reorder.Buffer
+
+	/* Client leg encryption, nil if disabled */
+	seal func([]byte) []byte
+
+	/* Forward error correction, nil if disabled */
+	fecEncoder *fec.Encoder
+	fecDecoder *fec.Decoder
+
+	/* Seen sequence numbers of replies, nil if disabled */
+	dedup *window.Window
+	lastSeq uint64
+
+	/* Number of sessions using flow */
+	sessions int
+}
+
+func newFlow(serverConn *socket, key string, clientAddr net.UDPAddr, localIP net.IP) *flow {
+	return &flow{
+		id: protocol.FlowId(key),
+		serverConn: serverConn,
+		key: key,
+		clientAddr: clientAddr,
+		localIP: localIP,
+	}
+}
+
+func (f *flow) nextSeq() uint32 {
+	return atomic.AddUint32(&f.seq, 1)
+}
+
+/**
+ * Current client address and local address it sends to
+ */
+func (f *flow) address() (net.UDPAddr, net.IP) {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.clientAddr, f.localIP
+}
+
+/**
+ * Move flow to new client address.
+ * Returns previous address and if it was changed
+ */
+func (f *flow) migrate(clientAddr net.UDPAddr, localIP net.IP) (net.UDPAddr, bool) {
+	f.Lock()
+	defer f.Unlock()
+
+	previous := f.clientAddr
+	if previous.IP.Equal(clientAddr.IP) && previous.Port == clientAddr.Port && f.localIP.Equal(localIP) {
+		return previous, false
+	}
+
+	f.clientAddr = clientAddr
+	f.localIP = localIP
+
+	return previous, true
+}
+
+/**
+ * Deliver reply from backend to client, outer tos is -1 if unknown
+ */
+func (f *flow) receive(header *protocol.Header, packet []byte, tos int, clampMss int) {
+	if header == nil {
+		if f.prepare(packet, tos, clampMss) {
+			f.write(packet)
+		}
+		return
+	}
+
+	// decoder gets packet as it was sent, before it is modified
+	var recovered []fec.Recovered
+	if f.fecDecoder != nil {
+		recovered = f.fecDecoder.AddData(header.Seq, packet)
+	}
+
+	if f.prepare(packet, tos, clampMss) {
+		f.deliver(header.Seq, packet)
+	}
+	f.deliverRecovered(recovered, tos, clampMss)
+}
+
+/**
+ * Handle parity packet from backend, delivering recovered packets
+ */
+func (f *flow) receiveParity(packet []byte, tos int, clampMss int) {
+	if f.fecDecoder == nil {
+		return
+	}
+
+	parity, err := fec.ParseParity(packet)
+	if err != nil {
+		return
+	}
+
+	f.deliverRecovered(f.fecDecoder.AddParity(parity), tos, clampMss)
+}
+
+/**
+ * Deliver packets recovered by fec, outer tos of packet
+ * completing recovery applies to them
+ */
+func (f *flow) deliverRecovered(recovered []fec.Recovered, tos int, clampMss int) {
+	for _, r := range recovered {
+		// decoder keeps recovered packet until its group expires
+		packet := make([]byte, len(r.Packet))
+		copy(packet, r.Packet)
+		if f.prepare(packet, tos, clampMss) {
+			f.deliver(r.Seq, packet)
+		}
+	}
+}
+
+/**
+ * Apply outer ECN and clamp MSS of reply in place,
+ * returns false if it must be dropped
+ */
+func (f *flow) prepare(packet []byte, tos int, clampMss int) bool {
+	if !ecn.Decap(tos, packet) {
+		return false
+	}
+	mss.Clamp(packet, clampMss)
+	return true
+}
+
+/**
+ * Pass packet with sequence number through dedup and reorder
+ */
+func (f *flow) deliver(seq uint32, packet []byte) {
+	if f.dedup != nil {
+		f.Lock()
+		ext := protocol.Unwrap(f.lastSeq, seq)
+		if ext > f.lastSeq {
+			f.lastSeq = ext
+		}
+		f.Unlock()
+		if !f.dedup.Accept(ext) {
+			return
+		}
+	}
+	if f.reorder != nil {
+		f.reorder.Push(seq, packet)
+		return
+	}
+	f.write(packet)
+}
+
+func (f *flow) write(packet []byte) {
+	if f.seal != nil {
+		packet = f.seal(packet)
+		if packet == nil {
+			return
+		}
+	}
+	clientAddr, localIP := f.address()
+	f.serverConn.write(packet, &clientAddr, localIP)
+}
+
+func (f *flow) Stop() {
+	if f.reorder != nil {
+		f.reorder.Stop()
+	}
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+
+	"../config"
+	"../core"
+	"../utils/consistent"
+	"../utils/labels"
+	"../utils/packet"
+)
+
+var errNoRouteBackends = errors.New("No live backends for route")
+
+/**
+ * Compiled routing rule, sends matched packets
+ * over backends matching label selector
+ */
+type route struct {
+	name     string
+	matcher  packet.Matcher
+	selector *labels.Selector
+
+	/* Use all backends if none matches selector, otherwise drop */
+	fallback bool
+
+	/* Live backends matching selector, used only from server loop */
+	backends   []*core.Backend
+	consistent *consistent.Consistent
+	warned     bool
+
+	/* Packets dropped having no backends */
+	drops uint64
+}
+
+/**
+ * Backends filter and routing rules
+ */
+type routing struct {
+	filter *labels.Selector
+	routes []*route
+}
+
+func newRouting(cfg config.Server) (*routing, error) {
+	filter, err := labels.ParseSelector(cfg.BackendSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &routing{filter: filter}
+
+	for i, c := range cfg.Routes {
+		rt := &route{
+			name: c.Name,
+			matcher: packet.Matcher{
+				Protocol: -1,
+				Dscp:     packet.IntSet(c.Dscp),
+				Ports:    packet.IntSet(c.Ports),
+			},
+			fallback:   c.Fallback,
+			consistent: consistent.New(),
+		}
+		if rt.name == "" {
+			rt.name = "#" + strconv.Itoa(i)
+		}
+
+		rt.selector, err = labels.ParseSelector(c.Backends)
+		if err != nil {
+			return nil, errors.New("Route " + rt.name + ": " + err.Error())
+		}
+		if c.Dst != "" {
+			_, rt.matcher.Dst, err = net.ParseCIDR(c.Dst)
+			if err != nil {
+				return nil, errors.New("Route " + rt.name + ": " + err.Error())
+			}
+		}
+		if c.Protocol != "" {
+			rt.matcher.Protocol = packet.Protocol(c.Protocol)
+			if rt.matcher.Protocol == -1 {
+				return nil, errors.New("Route " + rt.name + ": unknown protocol " + c.Protocol)
+			}
+		}
+		r.routes = append(r.routes, rt)
+	}
+
+	return r, nil
+}
+
+/**
+ * Live backends passing backends selector
+ */
+func (this *routing) filterBackends(backends []core.Backend) []core.Backend {
+	if this.filter == nil {
+		return backends
+	}
+
+	result := []core.Backend{}
+	for _, b := range backends {
+		if this.filter.Matches(b.Labels) {
+			result = append(result, b)
+		}
+	}
+	return result
+}
+
+/**
+ * Recompute backends of routes, called from server loop on live backends change
+ */
+func (this *routing) update(backends []*core.Backend) {
+	for _, rt := range this.routes {
+		rt.backends = nil
+		servers := []string{}
+		for _, b := range backends {
+			if rt.selector.Matches(b.Labels) {
+				rt.backends = append(rt.backends, b)
+				servers = append(servers, b.Target.String())
+			}
+		}
+		rt.consistent.Set(servers)
+		if len(rt.backends) > 0 {
+			rt.warned = false
+		}
+	}
+}
+
+/**
+ * Packets dropped by routes having no backends, by route name
+ */
+func (this *routing) drops() map[string]uint64 {
+	if this == nil || len(this.routes) == 0 {
+		return nil
+	}
+
+	result := make(map[string]uint64)
+	for _, rt := range this.routes {
+		result[rt.name] = atomic.LoadUint64(&rt.drops)
+	}
+	return result
+}
+
+/**
+ * First route matching packet, nil if packet should use all backends.
+ * Uses only configuration of routes, safe to call outside of server loop
+ */
+func (this *routing) match(header *ipv4.Header, buf []byte) *route {
+	if this == nil || header == nil {
+		return nil
+	}
+
+	for _, rt := range this.routes {
+		if rt.match(header, buf) {
+			return rt
+		}
+	}
+
+	return nil
+}
+
+func (r *route) match(header *ipv4.Header, buf []byte) bool {
+	return r.matcher.Match(header, buf, false)
+}
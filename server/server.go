@@ -3,9 +3,13 @@ package server
 import (
 	"net"
 	"time"
-	"strings"
 	"errors"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
 
+	"../acl"
 	"../logging"
 	"../config"
 	"../scheduler"
@@ -13,37 +17,154 @@ import (
 	"../healthcheck"
 	"../balance"
 	"../core"
+	"../protocol"
+	"../qos"
+	"../utils/aead"
+	"../utils/handshake"
 	"../utils/consistent"
+	"../utils/cookie"
+	"../utils/fec"
+	"../utils/mss"
+	"../utils/ratelimit"
+	"../utils/reorder"
+	"../utils/window"
 	"golang.org/x/net/ipv4"
 )
 
 const UDP_PACKET_SIZE = 1500
 
+/**
+ * Tunneled packets may carry headers and encryption overhead
+ */
+const TUNNEL_PACKET_SIZE = UDP_PACKET_SIZE + 64
+
+/**
+ * Fec defaults
+ */
+const (
+	DEFAULT_FEC_DATA = 8
+	DEFAULT_FEC_PARITY = 1
+	DEFAULT_FEC_TIMEOUT = 500 * time.Millisecond
+)
+
 type Server struct {
 	name string
 	cfg config.Server
 
 	scheduler *scheduler.Scheduler
+	balancer core.Balancer
 	consistent *consistent.Consistent
-	serverConn *net.UDPConn
+	serverConn *socket
 	stopped bool
 
 	liveBackendsMap map[string]*core.Backend
 	liveBackends []core.Backend
+	liveBackendsList []*core.Backend
+
+	/* Backends filter and routing rules */
+	routing *routing
+
+	/* Live backends, readable outside of server loop */
+	backendsSnapshot []core.Backend
+	backendsLock sync.RWMutex
+
+	/* Duplication policy, nil if disabled */
+	duplication *duplication
+	dedupWindow int
+
+	/* Fec group data and parity sizes, 0 if disabled */
+	fecData int
+	fecParity int
+	fecMaxParity int
+	fecTimeout time.Duration
+
+	/* Average loss of live backends, float64 bits */
+	loss uint64
+
+	/* Sessions failed to be created */
+	sessionErrors uint64
+
+	/* Flows by client address */
+	flows map[string]*flow
+
+	/* Ciphers of listener and backends, nil if not encrypted */
+	clientCipher *aead.Cipher
+	backendCiphers map[string]*aead.Cipher
+	clientChannels map[string]*aead.Channel
+	channelsLock sync.Mutex
+
+	/* Noise handshake of listener, nil if disabled */
+	responder *handshake.Responder
+	noiseSessions map[string]*handshake.Session
+	noiseStats NoiseStats
+
+	/* Clients having flow, readable outside of server loop */
+	clients map[string]bool
+	clientsLock sync.RWMutex
+
+	/* New clients admission, nil if disabled */
+	newSessionsBucket *ratelimit.Bucket
+	cookies *cookie.Checker
+	admissionStats AdmissionStats
+
+	/* Access control, nil if disabled */
+	acl *acl.Acl
+
+	/* Shaping of clients and backends */
+	clientPacketsRate float64
+	clientBytesRate float64
+	shapingBurst time.Duration
+	shapingMaxDelay time.Duration
+	clientLimiters map[string]*limiter
+	clientLimitersStats LimiterStats
+	backendLimiters map[core.Target]*limiter
+	limitersLock sync.Mutex
+
+	/* Egress queues of backends, nil policy if qos is disabled */
+	qos *qos.Policy
+	backendQueues map[core.Target]*qos.Queue
+
+	/* Egress rate of backends without own rate, queues only build when paced */
+	qosRate float64
+	unpacedBackends map[core.Target]bool
+	qosDrops uint64
+	queuesLock sync.Mutex
+
+	reorderWindow int
+	reorderTimeout time.Duration
+
+	/* Http endpoint of stats, nil if disabled */
+	statsServer *http.Server
 
 	getOrCreateChan chan *sessionRequest
-	removeChan chan string
+	removeChan chan sessionKey
 	stopChan chan bool
 }
 
 type sessionRequest struct {
+	connKey		string
 	clientAddr	net.UDPAddr
+	localIP		net.IP
 	ipv4Header	*ipv4.Header
+	route		*route
+	copies		int
 	response	chan sessionResponse
 }
 
+/**
+ * Session of client connection to backend
+ */
+type sessionKey struct {
+	connKey	string
+	target	string
+}
+
+func (this sessionKey) String() string {
+	return this.connKey + "->" + this.target
+}
+
 type sessionResponse struct {
-	session	*session
+	sessions	[]*session
 	err	error
 }
 
@@ -52,9 +173,24 @@ func New(name string, cfg config.Server) (*Server, error) {
 
 	consistent := consistent.New()
 
+	discoveries := cfg.Discoveries
+	if cfg.Discovery != nil {
+		discoveries = append([]config.DiscoveryConfig{*cfg.Discovery}, discoveries...)
+	}
+
+	var backendsDiscovery *discovery.Discovery
+	switch len(discoveries) {
+	case 0:
+		return nil, errors.New("No discovery configured")
+	case 1:
+		backendsDiscovery = discovery.New(discoveries[0].Kind, discoveries[0])
+	default:
+		backendsDiscovery = discovery.NewMulti(discoveries)
+	}
+
 	scheduler := &scheduler.Scheduler{
 		Balancer: balance.New(cfg.Balance),
-		Discovery: discovery.New(cfg.Discovery.Kind, *cfg.Discovery),
+		Discovery: backendsDiscovery,
 		Healthcheck: healthcheck.New(cfg.Healthcheck.Kind, *cfg.Healthcheck),
 	}
 	server := &Server{
@@ -62,11 +198,130 @@ func New(name string, cfg config.Server) (*Server, error) {
 		cfg:			cfg,
 		consistent:		consistent,
 		scheduler:		scheduler,
+		balancer:		balance.New(cfg.Balance),
+		flows:			make(map[string]*flow),
+		clientChannels:		make(map[string]*aead.Channel),
+		noiseSessions:		make(map[string]*handshake.Session),
+		clients:		make(map[string]bool),
+		backendQueues:		make(map[core.Target]*qos.Queue),
+		unpacedBackends:	make(map[core.Target]bool),
 		getOrCreateChan:	make(chan *sessionRequest),
-		removeChan:		make(chan string),
+		removeChan:		make(chan sessionKey),
 		stopChan:		make(chan bool),
 	}
 
+	if cfg.Balance == "bonding" {
+		if !cfg.Encapsulation {
+			return nil, errors.New("Bonding requires encapsulation to be enabled")
+		}
+
+		server.reorderWindow = 128
+		server.reorderTimeout = 50 * time.Millisecond
+		if cfg.Bonding != nil {
+			if cfg.Bonding.ReorderWindow > 0 {
+				server.reorderWindow = cfg.Bonding.ReorderWindow
+			}
+			if cfg.Bonding.ReorderTimeout != "" {
+				timeout, err := time.ParseDuration(cfg.Bonding.ReorderTimeout)
+				if err != nil {
+					return nil, err
+				}
+				server.reorderTimeout = timeout
+			}
+		}
+	}
+
+	if cfg.Duplication != nil {
+		if !cfg.Encapsulation {
+			return nil, errors.New("Duplication requires encapsulation to be enabled")
+		}
+
+		d, err := newDuplication(*cfg.Duplication)
+		if err != nil {
+			return nil, err
+		}
+		server.duplication = d
+		server.dedupWindow = cfg.Duplication.DedupWindow
+		if server.dedupWindow <= 0 {
+			server.dedupWindow = DEFAULT_DEDUP_WINDOW
+		}
+	}
+
+	if cfg.Fec != nil {
+		if !cfg.Encapsulation {
+			return nil, errors.New("Fec requires encapsulation to be enabled")
+		}
+
+		server.fecData = cfg.Fec.Data
+		if server.fecData <= 0 {
+			server.fecData = DEFAULT_FEC_DATA
+		}
+		server.fecParity = cfg.Fec.Parity
+		if server.fecParity <= 0 {
+			server.fecParity = DEFAULT_FEC_PARITY
+		}
+		server.fecMaxParity = cfg.Fec.MaxParity
+		if server.fecMaxParity == 0 {
+			server.fecMaxParity = server.fecData
+			if server.fecMaxParity < server.fecParity {
+				server.fecMaxParity = server.fecParity
+			}
+		}
+		if server.fecMaxParity < server.fecParity {
+			return nil, errors.New("Fec max_parity should not be less than parity")
+		}
+		if server.fecData + server.fecMaxParity > 256 {
+			return nil, errors.New("Fec data and parity shards should not exceed 256")
+		}
+		server.fecTimeout = DEFAULT_FEC_TIMEOUT
+		if cfg.Fec.Timeout != "" {
+			timeout, err := time.ParseDuration(cfg.Fec.Timeout)
+			if err != nil {
+				return nil, err
+			}
+			server.fecTimeout = timeout
+		}
+	}
+
+	if err := server.setupCrypto(); err != nil {
+		return nil, err
+	}
+
+	if err := server.setupAdmission(); err != nil {
+		return nil, err
+	}
+
+	if err := server.setupShaping(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Qos != nil {
+		policy, err := qos.NewPolicy(*cfg.Qos)
+		if err != nil {
+			return nil, err
+		}
+		server.qos = policy
+		if cfg.Qos.Rate != "" {
+			if server.qosRate, err = ratelimit.ParseRate(cfg.Qos.Rate); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	r, err := newRouting(cfg)
+	if err != nil {
+		return nil, err
+	}
+	server.routing = r
+
+	if cfg.Acl != nil {
+		a, err := acl.New(*cfg.Acl)
+		if err != nil {
+			return nil, err
+		}
+		server.acl = a
+	}
+
 	log.Info("Creating server '", name, "': ", cfg.Bind);
 
 	return server, nil
@@ -87,35 +342,51 @@ func (this *Server) Start() error {
 		return err
 	}
 
+	if err := this.startStats(); err != nil {
+		this.Stop()
+		log.Error("Error starting stats ", err);
+		return err
+	}
+
 	go func() {
-		sessions := make(map[string]*session)
+		sessions := make(map[sessionKey]*session)
 		for {
 			select {
 			case sessionRequest := <-this.getOrCreateChan:
-				skey, err := this.getSessionKey(sessionRequest)
+				skeys, err := this.getSessionKeys(sessionRequest)
 				if nil != err {
 					sessionRequest.response <- sessionResponse{
-						session:	nil,
+						sessions:	nil,
 						err:		err,
 					}
 					break
 				}
-				log.Debug("getting session: ", skey)
-				session, ok :=sessions[skey]
-				if ok {
-					sessionRequest.response <- sessionResponse{
-						session:	session,
-						err:		nil,
+				var result []*session
+				for _, skey := range skeys {
+					log.Debug("getting session: ", skey)
+					session, ok :=sessions[skey]
+					if !ok {
+						if !this.allowNewSession() {
+							err = errRateLimited
+							continue
+						}
+						session, err = this.makeSession(sessionRequest, skey)
+						if err != nil {
+							atomic.AddUint64(&this.sessionErrors, 1)
+							log.Debug("Error creating session ", skey, ": ", err)
+							continue
+						}
+						log.Info("new seesion: ", session)
+						sessions[skey] = session
 					}
-					break
+					result = append(result, session)
 				}
-				session, err = this.makeSession(sessionRequest.clientAddr, skey)
-				if err == nil {
-					log.Info("new seesion: ", session)
-					sessions[skey] = session
+				if len(result) > 0 {
+					err = nil
+					this.migrateFlow(result[0].flow, sessionRequest.clientAddr, sessionRequest.localIP)
 				}
 				sessionRequest.response <- sessionResponse{
-					session:	session,
+					sessions:	result,
 					err:		err,
 				}
 
@@ -126,25 +397,59 @@ func (this *Server) Start() error {
 				}
 				session.Stop()
 				delete(sessions, skey)
+				this.releaseFlow(session.flow)
 			case backends := <-this.scheduler.LiveBackendsChan:
+				backends = this.routing.filterBackends(backends)
 				updated := map[string]*core.Backend{}
+				updatedList := make([]*core.Backend, len(backends))
 				servers := make([]string, len(backends))
 				for i := range backends {
 					b := backends[i]
 					updated[b.Target.String()] = &b
+					updatedList[i] = &b
 					servers[i] = b.Target.String()
 				}
 				this.liveBackendsMap = updated
 				this.liveBackends = backends
+				this.liveBackendsList = updatedList
+				this.updateLoss(backends)
 				this.consistent.Set(servers)
+				this.routing.update(updatedList)
+				this.setBackendsSnapshot(backends)
 				log.Info("live backends:", servers)
+				used := map[core.Target]bool{}
+				for _, b := range backends {
+					used[b.Target] = true
+				}
 				for k, v := range sessions {
 					log.Info("session: ", k, "->", v.Backend().Target)
+					used[v.Backend().Target] = true
+				}
+				this.stopUnusedQueues(used)
+			case targets := <-this.scheduler.RemovedBackendsChan:
+				// address of backend hostname is gone, next packets
+				// of its sessions create sessions on remaining ones
+				removed := map[core.Target]bool{}
+				for _, target := range targets {
+					removed[target] = true
+				}
+				for skey, session := range sessions {
+					if !removed[session.Backend().Target] {
+						continue
+					}
+					log.Info("Moving session ", skey, " from removed address ", session.Backend().Target)
+					session.Stop()
+					delete(sessions, skey)
+					this.releaseFlow(session.flow)
 				}
 			case <-this.stopChan:
 				for _, session := range sessions {
 					session.Stop();
 				}
+				for _, flow := range this.flows {
+					flow.Stop()
+				}
+				this.stopQueues()
 				return
 			}
 		}
@@ -162,7 +467,7 @@ func (this *Server) Listen() error {
 		return err
 	}
 
-	this.serverConn, err = net.ListenUDP("udp", listenAddr)
+	this.serverConn, err = listenSocket(listenAddr)
 	if err != nil {
 		log.Error("Error start server  ", err)
 		return err
@@ -170,8 +475,8 @@ func (this *Server) Listen() error {
 
 	go func() {
 		for {
-			buf := make([]byte, UDP_PACKET_SIZE)
-			n, clientAddr, err := this.serverConn.ReadFromUDP(buf)
+			buf := make([]byte, TUNNEL_PACKET_SIZE)
+			n, clientAddr, localIP, err := this.serverConn.read(buf)
 			if err != nil {
 				if this.stopped {
 					return
@@ -181,27 +486,49 @@ func (this *Server) Listen() error {
 			}
 
 			go func(buf []byte) {
-				header, _ := ipv4.ParseHeader(buf)
-				responseChan := make(chan sessionResponse, 1)
-				//log.Debug("session request from ", clientAddr.String(), " header: ", header)
-				this.getOrCreateChan <- &sessionRequest{
-					clientAddr: *clientAddr,
-					ipv4Header: header,
-					response: responseChan,
+				if this.acl != nil && !this.acl.AllowClient(clientAddr.IP) {
+					return
 				}
 
-				response := <-responseChan
-				if response.err != nil {
-					log.Error("Error creating session ", response.err)
+				buf, ok := this.admit(*clientAddr, localIP, buf)
+				if !ok {
 					return
 				}
 
+				connKey := clientAddr.String()
 
-				err := response.session.send(buf)
+				if this.clientCrypto() {
+					plaintext, key, err := this.openClientPacket(*clientAddr, localIP, buf)
+					if err != nil {
+						log.Debug("Error decrypting packet from ", clientAddr, ": ", err)
+						return
+					}
+					if plaintext == nil {
+						return
+					}
+					buf = plaintext
+					connKey = key
+				}
+
+				header, err := ipv4.ParseHeader(buf)
 				if err != nil {
-					log.Error("Error sending data to backend ", err)
+					log.Debug("Error parsing ipv4 header ", err)
+					return
 				}
 
+				if this.acl != nil && !this.acl.AllowPacket(header, buf) {
+					return
+				}
+
+				// excess packets of client are delayed in order behind each other
+				if limiter := this.clientLimiter(connKey); limiter != nil {
+					limiter.admit(len(buf), func() {
+						this.forward(connKey, *clientAddr, localIP, header, buf)
+					})
+					return
+				}
+
+				this.forward(connKey, *clientAddr, localIP, header, buf)
 			}(buf[0:n])
 
 		}
@@ -210,13 +537,171 @@ func (this *Server) Listen() error {
 	return nil
 }
 
-func (this *Server) getSessionKey(req *sessionRequest) (string, error) {
+/**
+ * Send admitted packet of client to its sessions
+ */
+func (this *Server) forward(connKey string, clientAddr net.UDPAddr, localIP net.IP, header *ipv4.Header, buf []byte) {
 	log := logging.For("server")
 
-	server, err := this.consistent.Get(req.ipv4Header.Dst.String())
+	responseChan := make(chan sessionResponse, 1)
+	//log.Debug("session request from ", clientAddr.String(), " header: ", header)
+	request := sessionRequest{
+		connKey: connKey,
+		clientAddr: clientAddr,
+		localIP: localIP,
+		ipv4Header: header,
+		route: this.routing.match(header, buf),
+		copies: this.duplication.copies(header, buf),
+		response: responseChan,
+	}
+	this.getOrCreateChan <- &request
+
+	response := <-responseChan
+	if response.err == errRateLimited || response.err == errNoRouteBackends {
+		return
+	}
+	if response.err != nil {
+		log.Error("Error creating session ", response.err)
+		return
+	}
+
+	// all copies share the same sequence number
+	flow := response.sessions[0].flow
+	seq := flow.nextSeq()
+	for _, session := range response.sessions {
+		err := session.send(buf, seq)
+		if err != nil {
+			log.Error("Error sending data to backend ", err)
+		}
+	}
+
+	if flow.fecEncoder != nil {
+		parity, err := flow.fecEncoder.Add(seq, buf, this.currentFecParity())
+		if err != nil {
+			log.Error("Error encoding fec parity ", err)
+			return
+		}
+		if len(parity) > 0 {
+			this.sendParity(request, parity)
+		}
+	}
+}
+
+/**
+ * Send parity packets of data packet request spreading them over different backends
+ */
+func (this *Server) sendParity(request sessionRequest, parity []*fec.Parity) {
+	log := logging.For("server")
+
+	responseChan := make(chan sessionResponse, 1)
+	request.copies = len(parity)
+	request.response = responseChan
+	this.getOrCreateChan <- &request
+
+	response := <-responseChan
+	if response.err == errRateLimited || response.err == errNoRouteBackends {
+		return
+	}
+	if response.err != nil {
+		log.Error("Error creating session for parity ", response.err)
+		return
+	}
+
+	for i, p := range parity {
+		session := response.sessions[i%len(response.sessions)]
+		if err := session.sendParity(p); err != nil {
+			log.Error("Error sending parity to backend ", err)
+		}
+	}
+}
+
+/**
+ * Number of parity packets per fec group,
+ * adapted to measured loss if configured
+ */
+func (this *Server) currentFecParity() int {
+	if !this.cfg.Fec.Adaptive {
+		return this.fecParity
+	}
+
+	loss := math.Float64frombits(atomic.LoadUint64(&this.loss))
+	if loss >= 1 {
+		return this.fecMaxParity
+	}
+
+	parity := int(math.Ceil(float64(this.fecData) * loss / (1 - loss)))
+	if parity < this.fecParity {
+		parity = this.fecParity
+	}
+	if parity > this.fecMaxParity {
+		parity = this.fecMaxParity
+	}
+
+	return parity
+}
+
+/**
+ * Remember average loss of live backends
+ */
+func (this *Server) updateLoss(backends []core.Backend) {
+	loss := 0.0
+	for _, b := range backends {
+		loss += b.Stats.Loss
+	}
+	if len(backends) > 0 {
+		loss /= float64(len(backends))
+	}
+	atomic.StoreUint64(&this.loss, math.Float64bits(loss))
+}
+
+func (this *Server) getSessionKeys(req *sessionRequest) ([]sessionKey, error) {
+	log := logging.For("server")
+
+	ring, list := this.consistent, this.liveBackendsList
+	if rt := req.route; rt != nil {
+		switch {
+		case len(rt.backends) > 0:
+			ring, list = rt.consistent, rt.backends
+		case rt.fallback:
+			log.Debug("No live backends for route ", rt.name, ", using all backends")
+		default:
+			atomic.AddUint64(&rt.drops, 1)
+			// warn once until route has backends again
+			if !rt.warned {
+				rt.warned = true
+				log.Warn("No live backends for route ", rt.name, ", dropping its packets")
+			}
+			return nil, errNoRouteBackends
+		}
+	}
+
+	if req.copies > 1 {
+		servers, err := ring.GetN(req.ipv4Header.Dst.String(), req.copies)
+		if err != nil {
+			return nil, err
+		}
+		skeys := make([]sessionKey, len(servers))
+		for i, server := range servers {
+			skeys[i] = sessionKey{req.connKey, server}
+		}
+		log.Debug("duplicating over: ", servers, " for: ", req.clientAddr, "->", req.ipv4Header.Dst)
+		return skeys, nil
+	}
+
+	if this.cfg.Balance == "bonding" {
+		backend, err := this.balancer.Elect(&core.UdpContext{
+			RemoteAddr: req.clientAddr,
+		}, list)
+		if err != nil {
+			return nil, err
+		}
+		return []sessionKey{{req.connKey, backend.Target.String()}}, nil
+	}
+
+	server, err := ring.Get(req.ipv4Header.Dst.String())
 
 	if nil != err {
-		return "", err
+		return nil, err
 	}
 
 	//bucket := hasher.HashString(req.ipv4Header.Dst.String(), int32(len(this.liveBackends)))
@@ -236,27 +721,25 @@ func (this *Server) getSessionKey(req *sessionRequest) (string, error) {
 	log.Debug("hash server: ", server, " for: ", req.clientAddr, "->", req.ipv4Header.Dst)
 
 
-	return req.clientAddr.String() + ":" + server, nil
+	return []sessionKey{{req.connKey, server}}, nil
 }
-func (this *Server) getBackendBySessionKey(sessionKey string) (*core.Backend, error) {
-	items := strings.SplitN(sessionKey, ":", 3)
-	server := items[len(items)-1]
-	backend, ok := this.liveBackendsMap[server]
+func (this *Server) getBackendBySessionKey(key sessionKey) (*core.Backend, error) {
+	backend, ok := this.liveBackendsMap[key.target]
 	if !ok {
 		return nil, errors.New("Not found")
 	}
 	return backend, nil
 }
 
-func (this *Server) makeSession(clientAddr net.UDPAddr, sessionKey string) (*session, error) {
+func (this *Server) makeSession(req *sessionRequest, key sessionKey) (*session, error) {
 	log := logging.For("server")
 
 	/*
 	backend, err := this.scheduler.TakeBackend(&core.UdpContext{
-		RemoteAddr: clientAddr,
+		RemoteAddr: req.clientAddr,
 	})
 	*/
-	backend, err := this.getBackendBySessionKey(sessionKey)
+	backend, err := this.getBackendBySessionKey(key)
 	if err != nil {
 		log.Error("Error take backend server", err)
 		return nil, err
@@ -264,20 +747,48 @@ func (this *Server) makeSession(clientAddr net.UDPAddr, sessionKey string) (*ses
 
 	backendTimeout, err := time.ParseDuration("0s")
 
+	cipher, err := this.backendCipher(backend)
+	if err != nil {
+		log.Error("Error take backend cipher ", err)
+		return nil, err
+	}
+
+	flow := this.acquireFlow(req)
+
 	session := &session{
 		backendIdleTimeout: backendTimeout,
-		serverConn: this.serverConn,
-		clientAddr: clientAddr,
-		sessionKey: sessionKey,
+		clientAddr: req.clientAddr,
+		sessionKey: key,
 		notifyClosed: func() {
-			this.removeChan <- sessionKey
+			this.removeChan <- key
+		},
+		notifyDropped: func() {
+			atomic.AddUint64(&this.qosDrops, 1)
 		},
 		backend: backend,
+		flow: flow,
+		clampMss: this.clampMss(backend),
+		limiter: this.backendLimiter(backend),
+		queue: this.backendQueue(backend),
+		marker: newMarker(backend),
+	}
+
+	if cipher != nil {
+		session.channel = cipher.Channel()
+	}
+
+	if this.cfg.Encapsulation {
+		session.header = &protocol.Header{
+			Version: protocol.VERSION,
+			FlowId: flow.id,
+			PathId: protocol.PathId(backend.Target.String()),
+		}
 	}
 
 	err = session.Start()
 	if err != nil {
 		session.Stop()
+		this.releaseFlow(flow)
 		return nil, err
 	}
 
@@ -285,12 +796,81 @@ func (this *Server) makeSession(clientAddr net.UDPAddr, sessionKey string) (*ses
 
 }
 
+/**
+ * Get or create flow of client, should be called from server loop
+ */
+func (this *Server) acquireFlow(req *sessionRequest) *flow {
+	f, ok := this.flows[req.connKey]
+	if !ok {
+		f = newFlow(this.serverConn, req.connKey, req.clientAddr, req.localIP)
+		if this.cfg.Balance == "bonding" {
+			f.reorder = reorder.New(this.reorderWindow, this.reorderTimeout, f.write)
+		}
+		if this.duplication != nil {
+			f.dedup = window.New(this.dedupWindow)
+		}
+		f.seal = this.clientSealer(req.connKey)
+		this.addClientLimiter(req.connKey)
+		this.setKnownClient(req.clientAddr, true)
+		if this.fecData > 0 {
+			f.fecEncoder = fec.NewEncoder(this.fecData, this.fecTimeout)
+			f.fecDecoder = fec.NewDecoder(this.fecTimeout)
+		}
+		this.flows[req.connKey] = f
+	}
+	f.sessions++
+	return f
+}
+
+/**
+ * Release flow of closed session, should be called from server loop
+ */
+func (this *Server) releaseFlow(f *flow) {
+	f.sessions--
+	if f.sessions > 0 {
+		return
+	}
+	f.Stop()
+	clientAddr, _ := f.address()
+	delete(this.flows, f.key)
+	this.setKnownClient(clientAddr, false)
+	this.removeClientLimiter(f.key)
+	if this.clientCrypto() {
+		this.removeClientChannel(f.key)
+	}
+}
+
+/**
+ * Bytes added to every inner packet on the way to backend
+ */
+func (this *Server) overhead(backend *core.Backend) int {
+	overhead := mss.IPV4_HEADER_LEN + mss.UDP_HEADER_LEN
+	if this.cfg.Encapsulation {
+		overhead += protocol.HEADER_LEN
+	}
+	if cipher, _ := this.backendCipher(backend); cipher != nil {
+		overhead += aead.OVERHEAD
+	}
+	return overhead
+}
+
+/**
+ * Mss to clamp inner tcp to for backend, 0 if clamping is off
+ */
+func (this *Server) clampMss(backend *core.Backend) int {
+	if !this.cfg.MssClamp || backend.Mtu == 0 {
+		return 0
+	}
+	return mss.ForMtu(backend.Mtu - this.overhead(backend))
+}
+
 func (this *Server) Stop() {
 	log := logging.For("server")
 	log.Info("Stopping ", this.name)
 
 	this.stopped = true
 	this.serverConn.Close()
+	this.stopStats()
 
 	this.scheduler.Stop()
 	this.stopChan <- true
@@ -6,32 +6,49 @@ import (
 
 	"../logging"
 	"../core"
+	"../protocol"
+	"../utils/aead"
+	"../utils/dial"
+	"../utils/fec"
+	"../qos"
+	"../utils/mss"
+	"../utils/packet"
 )
 
 type session struct {
-	serverConn *net.UDPConn
 	clientAddr net.UDPAddr
 	backend *core.Backend
+	flow *flow
 	backendIdleTimeout time.Duration
 	backendConn *net.UDPConn
-	sessionKey string
+	sessionKey sessionKey
+	clampMss int
+
+	/* Backend rate limiter, nil if not limited */
+	limiter *limiter
+
+	/* Backend egress queue, nil if qos is disabled */
+	queue *qos.Queue
+
+	/* Outer TOS marking, nil if disabled */
+	marker *marker
+
+	/* Encapsulation header template, nil if disabled */
+	header *protocol.Header
+
+	/* Backend leg encryption, nil if disabled */
+	channel *aead.Channel
 
 	stopC chan bool
 	notifyClosed func()
+	notifyDropped func()
 }
 
 func (s *session) Start() error {
 	log := logging.For("server/session")
 	s.stopC = make(chan bool)
 
-	backendAddr, err := net.ResolveUDPAddr("udp", s.backend.Target.String())
-
-	if err != nil {
-		log.Error("Error ResolveUDPAddr: ", err)
-		return err
-	}
-
-	backendConn, err := net.DialUDP("udp", nil, backendAddr)
+	backendConn, err := dial.UDP(s.backend.Target)
 
 	if err != nil {
 		log.Debug("Error connecting to backend: ", err)
@@ -40,6 +57,12 @@ func (s *session) Start() error {
 
 	s.backendConn = backendConn
 
+	if s.marker != nil {
+		if err := s.marker.attach(backendConn); err != nil {
+			log.Warn("Error enabling tos receive for backend ", err)
+		}
+	}
+
 	stopped := false
 
 	go func() {
@@ -56,7 +79,9 @@ func (s *session) Start() error {
 	}()
 
 	go func() {
-		buf := make([]byte, UDP_PACKET_SIZE)
+		buf := make([]byte, TUNNEL_PACKET_SIZE)
+		oob := make([]byte, 64)
+		var err error
 
 		for {
 			if s.backendIdleTimeout > 0 {
@@ -67,7 +92,12 @@ func (s *session) Start() error {
 					return
 				}
 			}
-			n, _, err := s.backendConn.ReadFromUDP(buf)
+			n, tos := 0, -1
+			if s.marker != nil {
+				n, tos, err = readWithTos(s.backendConn, buf, oob)
+			} else {
+				n, _, err = s.backendConn.ReadFromUDP(buf)
+			}
 			if err != nil {
 				if !err.(*net.OpError).Timeout() && !stopped {
 					log.Error("Error reading from backend ", err)
@@ -75,7 +105,27 @@ func (s *session) Start() error {
 				s.Stop()
 				return
 			}
-			s.serverConn.WriteToUDP(buf[0:n], &s.clientAddr)
+			packet := buf[0:n]
+			if s.channel != nil {
+				packet, err = s.channel.Open(packet)
+				if err != nil {
+					log.Debug("Error decrypting packet from backend ", err)
+					continue
+				}
+			}
+			var header *protocol.Header
+			if s.header != nil {
+				header, packet, err = protocol.Decode(packet)
+				if err != nil {
+					log.Debug("Error decoding packet from backend ", err)
+					continue
+				}
+			}
+			if header != nil && header.Flags&protocol.FLAG_FEC_PARITY != 0 {
+				s.flow.receiveParity(packet, tos, s.clampMss)
+				continue
+			}
+			s.flow.receive(header, packet, tos, s.clampMss)
 		}
 	}()
 
@@ -87,7 +137,71 @@ func (s *session) Backend() *core.Backend {
 }
 
 
-func (s *session) send(buf []byte) error {
+func (s *session) send(buf []byte, seq uint32) error {
+	mss.Clamp(buf, s.clampMss)
+
+	tos := 0
+	if len(buf) > 1 {
+		tos = int(buf[1])
+	}
+
+	return s.write(buf, seq, 0, tos)
+}
+
+func (s *session) sendParity(parity *fec.Parity) error {
+	return s.write(parity.Marshal(), parity.Base, protocol.FLAG_FEC_PARITY, 0)
+}
+
+func (s *session) write(buf []byte, seq uint32, flags uint8, tos int) error {
+	if s.header != nil {
+		header := *s.header
+		header.Flags = flags
+		header.Seq = seq
+		header.Timestamp = protocol.Timestamp()
+		buf = protocol.Encode(&header, buf)
+	}
+
+	if s.channel != nil {
+		buf = s.channel.Seal(buf)
+	}
+
+	if s.queue != nil {
+		queued := s.queue.Enqueue(packet.Dscp(tos), len(buf), func() {
+			if s.limiter != nil {
+				s.limiter.wait(len(buf))
+			}
+			if err := s.transmit(buf, tos); err != nil {
+				logging.For("server/session").Error("Error sending data to backend ", err)
+			}
+		})
+		if !queued {
+			s.notifyDropped()
+			logging.For("server/session").Debug("Egress queue of ", s.backend.Target.String(), " is full, dropped packet with dscp ", packet.Dscp(tos))
+		}
+		return nil
+	}
+
+	if s.limiter != nil {
+		// excess packets are delayed in order behind each other
+		s.limiter.admit(len(buf), func() {
+			if err := s.transmit(buf, tos); err != nil {
+				logging.For("server/session").Error("Error sending data to backend ", err)
+			}
+		})
+		return nil
+	}
+
+	return s.transmit(buf, tos)
+}
+
+/**
+ * Write packet to backend, marking outer header by inner tos
+ */
+func (s *session) transmit(buf []byte, tos int) error {
+	if s.marker != nil {
+		return s.marker.write(s.backendConn, buf, tos)
+	}
+
 	_, err := s.backendConn.Write(buf)
 	if err != nil {
 		return err
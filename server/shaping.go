@@ -0,0 +1,340 @@
+package server
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"../core"
+	"../utils/ratelimit"
+)
+
+/**
+ * Burst allowed by default, as time worth of rate
+ */
+const DEFAULT_SHAPING_BURST = 100 * time.Millisecond
+
+/**
+ * Packets and bytes rate limiter
+ */
+type limiter struct {
+	/* Makes check and take of both buckets atomic */
+	mutex sync.Mutex
+
+	packets *ratelimit.Bucket
+	bytes *ratelimit.Bucket
+	bytesRate float64
+	burst time.Duration
+
+	/* Max time to delay excess packet, 0 drops it */
+	maxDelay time.Duration
+
+	/* Delayed packets, sent in order by single goroutine */
+	queue []delayedPacket
+	sending bool
+
+	dropped uint64
+	delayed uint64
+}
+
+/**
+ * Packet waiting until it conforms to limits
+ */
+type delayedPacket struct {
+	at time.Time
+	send func()
+}
+
+/**
+ * Creates limiter, zero rate means no limit
+ */
+func newLimiter(packetsRate float64, bytesRate float64, burst time.Duration, maxDelay time.Duration) *limiter {
+	l := &limiter{maxDelay: maxDelay, bytesRate: bytesRate, burst: burst}
+
+	if packetsRate > 0 {
+		packetsBurst := packetsRate * burst.Seconds()
+		if packetsBurst < 1 {
+			packetsBurst = 1
+		}
+		l.packets = ratelimit.New(packetsRate, packetsBurst)
+	}
+
+	if bytesRate > 0 {
+		l.bytes = ratelimit.New(bytesRate, bytesBurst(bytesRate, burst))
+	}
+
+	return l
+}
+
+func bytesBurst(bytesRate float64, burst time.Duration) float64 {
+	bytes := bytesRate * burst.Seconds()
+	if bytes < TUNNEL_PACKET_SIZE {
+		bytes = TUNNEL_PACKET_SIZE
+	}
+	return bytes
+}
+
+/**
+ * Change bytes rate in place, so sessions sharing limiter keep it
+ */
+func (l *limiter) setBytesRate(bytesRate float64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.bytesRate = bytesRate
+	l.bytes.SetRate(bytesRate, bytesBurst(bytesRate, l.burst))
+}
+
+/**
+ * Send packet of size when it conforms to limits. Excess packets are
+ * queued behind previous ones, so caller never waits and order is kept.
+ * Returns false if packet is dropped
+ */
+func (l *limiter) admit(size int, send func()) bool {
+	l.mutex.Lock()
+
+	wait, ok := l.reserve(size, l.maxDelay)
+	if !ok {
+		l.mutex.Unlock()
+		return false
+	}
+
+	if wait == 0 && !l.sending {
+		l.mutex.Unlock()
+		send()
+		return true
+	}
+
+	l.queue = append(l.queue, delayedPacket{at: time.Now().Add(wait), send: send})
+	if !l.sending {
+		l.sending = true
+		go l.drain()
+	}
+	l.mutex.Unlock()
+
+	return true
+}
+
+/**
+ * Wait until packet of size conforms to limits, however long it takes
+ * Used behind egress queues, which bound the delay by their depth
+ */
+func (l *limiter) wait(size int) {
+	l.mutex.Lock()
+	wait, _ := l.reserve(size, time.Duration(math.MaxInt64))
+	l.mutex.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+/**
+ * Take tokens for packet of size, returns time until it conforms
+ * and false if that's longer than max delay. Should be called locked
+ */
+func (l *limiter) reserve(size int, maxDelay time.Duration) (time.Duration, bool) {
+	var wait time.Duration
+
+	// tokens are taken only if packet conforms to both buckets
+	if l.packets != nil {
+		wait = l.packets.Wait(1)
+	}
+	if l.bytes != nil {
+		if w := l.bytes.Wait(float64(size)); w > wait {
+			wait = w
+		}
+	}
+	if wait > maxDelay {
+		atomic.AddUint64(&l.dropped, 1)
+		return 0, false
+	}
+
+	// delayed packets take tokens in advance, so next ones wait behind them
+	if l.packets != nil {
+		l.packets.Take(1)
+	}
+	if l.bytes != nil {
+		l.bytes.Take(float64(size))
+	}
+
+	if wait > 0 {
+		atomic.AddUint64(&l.delayed, 1)
+	}
+
+	return wait, true
+}
+
+/**
+ * Send queued packets in order when they are due
+ */
+func (l *limiter) drain() {
+	for {
+		l.mutex.Lock()
+		if len(l.queue) == 0 {
+			l.sending = false
+			l.mutex.Unlock()
+			return
+		}
+		p := l.queue[0]
+		l.queue[0] = delayedPacket{}
+		l.queue = l.queue[1:]
+		l.mutex.Unlock()
+
+		if wait := time.Until(p.at); wait > 0 {
+			time.Sleep(wait)
+		}
+		p.send()
+	}
+}
+
+/**
+ * Limiter counters
+ */
+type LimiterStats struct {
+	Dropped uint64 `json:"dropped"`
+	Delayed uint64 `json:"delayed"`
+}
+
+func (l *limiter) stats() LimiterStats {
+	return LimiterStats{
+		Dropped: atomic.LoadUint64(&l.dropped),
+		Delayed: atomic.LoadUint64(&l.delayed),
+	}
+}
+
+/**
+ * Setup shaping from configuration
+ */
+func (this *Server) setupShaping() error {
+	this.clientLimiters = make(map[string]*limiter)
+	this.backendLimiters = make(map[core.Target]*limiter)
+	this.shapingBurst = DEFAULT_SHAPING_BURST
+
+	if this.cfg.Shaping == nil {
+		return nil
+	}
+
+	var err error
+
+	if this.shapingMaxDelay, err = parseOptionalDuration(this.cfg.Shaping.MaxDelay); err != nil {
+		return err
+	}
+
+	if this.cfg.Shaping.Burst != "" {
+		if this.shapingBurst, err = time.ParseDuration(this.cfg.Shaping.Burst); err != nil {
+			return err
+		}
+	}
+
+	this.clientPacketsRate = this.cfg.Shaping.ClientPackets
+	if this.cfg.Shaping.ClientBytes != "" {
+		if this.clientBytesRate, err = ratelimit.ParseRate(this.cfg.Shaping.ClientBytes); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/**
+ * Get limiter of client, nil if clients are not limited or client has no flow yet
+ */
+func (this *Server) clientLimiter(key string) *limiter {
+	this.limitersLock.Lock()
+	defer this.limitersLock.Unlock()
+
+	return this.clientLimiters[key]
+}
+
+/**
+ * Create limiter of client when its flow is created,
+ * so that only clients with flows have limiters
+ */
+func (this *Server) addClientLimiter(key string) {
+	if this.clientPacketsRate == 0 && this.clientBytesRate == 0 {
+		return
+	}
+
+	this.limitersLock.Lock()
+	defer this.limitersLock.Unlock()
+
+	if _, ok := this.clientLimiters[key]; !ok {
+		this.clientLimiters[key] = newLimiter(this.clientPacketsRate, this.clientBytesRate, this.shapingBurst, this.shapingMaxDelay)
+	}
+}
+
+/**
+ * Forget limiter of client
+ */
+func (this *Server) removeClientLimiter(key string) {
+	this.limitersLock.Lock()
+	defer this.limitersLock.Unlock()
+
+	if l, ok := this.clientLimiters[key]; ok {
+		this.clientLimitersStats.Dropped += l.stats().Dropped
+		this.clientLimitersStats.Delayed += l.stats().Delayed
+		delete(this.clientLimiters, key)
+	}
+}
+
+/**
+ * Get limiter of backend shared by all its sessions, nil if not limited
+ * Rate of existing limiter is changed in place if backend rate changes
+ */
+func (this *Server) backendLimiter(backend *core.Backend) *limiter {
+	this.limitersLock.Lock()
+	defer this.limitersLock.Unlock()
+
+	l, ok := this.backendLimiters[backend.Target]
+
+	rate := this.backendRate(backend)
+	if rate == 0 {
+		if ok {
+			delete(this.backendLimiters, backend.Target)
+		}
+		return nil
+	}
+
+	if !ok {
+		l = newLimiter(0, rate, this.shapingBurst, this.shapingMaxDelay)
+		this.backendLimiters[backend.Target] = l
+	} else if l.bytesRate != rate {
+		l.setBytesRate(rate)
+	}
+
+	return l
+}
+
+/**
+ * Egress rate of backend, qos rate if it has no own rate and qos is enabled
+ */
+func (this *Server) backendRate(backend *core.Backend) float64 {
+	if backend.Rate == 0 && this.qos != nil {
+		return this.qosRate
+	}
+	return backend.Rate
+}
+
+/**
+ * Shaping counters, clients total and by backend
+ */
+func (this *Server) shapingStats() (LimiterStats, map[string]LimiterStats) {
+	this.limitersLock.Lock()
+	defer this.limitersLock.Unlock()
+
+	clients := this.clientLimitersStats
+	for _, l := range this.clientLimiters {
+		s := l.stats()
+		clients.Dropped += s.Dropped
+		clients.Delayed += s.Delayed
+	}
+
+	backends := make(map[string]LimiterStats)
+	for target, l := range this.backendLimiters {
+		backends[target.String()] = l.stats()
+	}
+
+	return clients, backends
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"../core"
+)
+
+func TestLimiterKeepsOrder(t *testing.T) {
+	// one packet of burst, then 100 packets per second
+	l := newLimiter(100, 0, 0, time.Second)
+
+	var lock sync.Mutex
+	var sent []int
+	done := make(chan bool)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		i := i
+		if !l.admit(100, func() {
+			lock.Lock()
+			sent = append(sent, i)
+			if len(sent) == 5 {
+				close(done)
+			}
+			lock.Unlock()
+		}) {
+			t.Fatalf("packet %d dropped", i)
+		}
+	}
+
+	// caller is not delayed by shaping
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Fatalf("admit blocked for %v", elapsed)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("delayed packets were not sent")
+	}
+
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Fatalf("packets were not delayed, sent in %v", elapsed)
+	}
+	for i, n := range sent {
+		if n != i {
+			t.Fatalf("packets sent out of order %v", sent)
+		}
+	}
+	if s := l.stats(); s.Delayed != 4 || s.Dropped != 0 {
+		t.Fatalf("stats %+v", s)
+	}
+}
+
+func TestLimiterDropsOverMaxDelay(t *testing.T) {
+	l := newLimiter(10, 0, 0, 0)
+
+	sent := 0
+	for i := 0; i < 3; i++ {
+		l.admit(100, func() { sent++ })
+	}
+	if sent != 1 || l.stats().Dropped != 2 {
+		t.Fatalf("sent %d, stats %+v", sent, l.stats())
+	}
+}
+
+func TestBackendLimiterRateChange(t *testing.T) {
+	this := &Server{backendLimiters: make(map[core.Target]*limiter), shapingBurst: DEFAULT_SHAPING_BURST}
+	backend := &core.Backend{Target: core.Target{Host: "127.0.0.1", Port: "4000"}, Rate: 1000}
+
+	l := this.backendLimiter(backend)
+	if l == nil {
+		t.Fatal("limited backend has no limiter")
+	}
+
+	// sessions keep limiter, so its rate is changed in place
+	backend.Rate = 2000
+	if changed := this.backendLimiter(backend); changed != l || l.bytesRate != 2000 {
+		t.Fatalf("limiter was replaced or not updated, rate %v", l.bytesRate)
+	}
+
+	backend.Rate = 0
+	if this.backendLimiter(backend) != nil || len(this.backendLimiters) != 0 {
+		t.Fatal("limiter of unlimited backend was kept")
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/**
+ * Server listening socket.
+ * When bound to wildcard address, records local address
+ * every packet was sent to, so replies leave from it
+ */
+type socket struct {
+	*net.UDPConn
+
+	/* Packet info connections, at most one is set */
+	v4 *ipv4.PacketConn
+	v6 *ipv6.PacketConn
+}
+
+/**
+ * Listen on address, enabling packet info for wildcard address
+ */
+func listenSocket(addr *net.UDPAddr) (*socket, error) {
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &socket{UDPConn: conn}
+
+	if addr.IP != nil && !addr.IP.IsUnspecified() {
+		return s, nil
+	}
+
+	if addr.IP != nil && addr.IP.To4() != nil {
+		s.v4 = ipv4.NewPacketConn(conn)
+		if err := s.v4.SetControlMessage(ipv4.FlagDst, true); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return s, nil
+	}
+
+	// dual stack socket, ipv4 packets have mapped addresses
+	s.v6 = ipv6.NewPacketConn(conn)
+	if err := s.v6.SetControlMessage(ipv6.FlagDst, true); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+/**
+ * Read packet, returning its source and local destination address.
+ * Local address is nil if not known
+ */
+func (this *socket) read(buf []byte) (int, *net.UDPAddr, net.IP, error) {
+
+	switch {
+	case this.v4 != nil:
+		n, cm, addr, err := this.v4.ReadFrom(buf)
+		if err != nil {
+			return n, nil, nil, err
+		}
+		var local net.IP
+		if cm != nil {
+			local = cm.Dst
+		}
+		return n, addr.(*net.UDPAddr), local, nil
+
+	case this.v6 != nil:
+		n, cm, addr, err := this.v6.ReadFrom(buf)
+		if err != nil {
+			return n, nil, nil, err
+		}
+		var local net.IP
+		if cm != nil {
+			local = cm.Dst
+		}
+		return n, addr.(*net.UDPAddr), local, nil
+	}
+
+	n, addr, err := this.ReadFromUDP(buf)
+	return n, addr, nil, err
+}
+
+/**
+ * Write packet to addr from local address, if known
+ */
+func (this *socket) write(buf []byte, addr *net.UDPAddr, local net.IP) error {
+
+	var err error
+
+	switch {
+	case local != nil && this.v4 != nil:
+		_, err = this.v4.WriteTo(buf, &ipv4.ControlMessage{Src: local}, addr)
+	case local != nil && this.v6 != nil && local.To4() != nil:
+		_, _, err = this.WriteMsgUDP(buf, mappedPktinfo(local), addr)
+	case local != nil && this.v6 != nil:
+		_, err = this.v6.WriteTo(buf, &ipv6.ControlMessage{Src: local}, addr)
+	default:
+		_, err = this.WriteToUDP(buf, addr)
+	}
+
+	return err
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+/**
+ * IPV6_PKTINFO control message with ipv4-mapped source address,
+ * which is not marshalled by ipv6.ControlMessage
+ */
+func mappedPktinfo(src net.IP) []byte {
+
+	b := make([]byte, syscall.CmsgSpace(syscall.SizeofInet6Pktinfo))
+
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = syscall.IPPROTO_IPV6
+	h.Type = syscall.IPV6_PKTINFO
+	h.SetLen(syscall.CmsgLen(syscall.SizeofInet6Pktinfo))
+
+	info := (*syscall.Inet6Pktinfo)(unsafe.Pointer(&b[syscall.CmsgLen(0)]))
+	copy(info.Addr[:], src.To16())
+
+	return b
+}
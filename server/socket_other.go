@@ -0,0 +1,14 @@
+// +build !linux
+
+package server
+
+import (
+	"net"
+)
+
+/**
+ * Sending from ipv4-mapped address is supported on linux only
+ */
+func mappedPktinfo(src net.IP) []byte {
+	return nil
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"sync/atomic"
+
+	"../acl"
+	"../core"
+	"../qos"
+	"../utils/aead"
+)
+
+/**
+ * Server counters
+ */
+type Stats struct {
+	Crypto map[string]aead.Stats `json:"crypto"`
+	Noise  NoiseStats            `json:"noise"`
+	Admission AdmissionStats     `json:"admission"`
+	Acl    *acl.Stats            `json:"acl,omitempty"`
+	Shaping ShapingStats         `json:"shaping"`
+	Qos    map[string]map[string]qos.ClassStats `json:"qos,omitempty"`
+	QosDrops uint64              `json:"qos_drops"`
+	Backends []core.Backend      `json:"backends"`
+	SessionErrors uint64         `json:"session_errors"`
+	RouteDrops map[string]uint64 `json:"route_drops,omitempty"`
+}
+
+/**
+ * Shaping counters
+ */
+type ShapingStats struct {
+	Clients  LimiterStats            `json:"clients"`
+	Backends map[string]LimiterStats `json:"backends"`
+}
+
+/**
+ * New clients admission counters
+ */
+type AdmissionStats struct {
+	CookiesSent     uint64 `json:"cookies_sent"`
+	CookiesAccepted uint64 `json:"cookies_accepted"`
+	CookiesRejected uint64 `json:"cookies_rejected"`
+	RateLimited     uint64 `json:"rate_limited"`
+}
+
+/**
+ * Noise handshake counters
+ */
+type NoiseStats struct {
+	Handshakes        uint64 `json:"handshakes"`
+	HandshakeFailures uint64 `json:"handshake_failures"`
+	AuthFailures      uint64 `json:"auth_failures"`
+}
+
+/**
+ * Get current server counters
+ */
+func (this *Server) Stats() Stats {
+	stats := Stats{
+		Crypto: make(map[string]aead.Stats),
+	}
+
+	if this.clientCipher != nil {
+		stats.Crypto["listener"] = this.clientCipher.Stats()
+	}
+	for name, cipher := range this.backendCiphers {
+		stats.Crypto["backend/"+name] = cipher.Stats()
+	}
+
+	stats.Noise = NoiseStats{
+		Handshakes:        atomic.LoadUint64(&this.noiseStats.Handshakes),
+		HandshakeFailures: atomic.LoadUint64(&this.noiseStats.HandshakeFailures),
+		AuthFailures:      atomic.LoadUint64(&this.noiseStats.AuthFailures),
+	}
+
+	stats.Admission = AdmissionStats{
+		CookiesSent:     atomic.LoadUint64(&this.admissionStats.CookiesSent),
+		CookiesAccepted: atomic.LoadUint64(&this.admissionStats.CookiesAccepted),
+		CookiesRejected: atomic.LoadUint64(&this.admissionStats.CookiesRejected),
+		RateLimited:     atomic.LoadUint64(&this.admissionStats.RateLimited),
+	}
+
+	stats.Shaping.Clients, stats.Shaping.Backends = this.shapingStats()
+	stats.Qos = this.qosStats()
+	stats.QosDrops = atomic.LoadUint64(&this.qosDrops)
+
+	stats.Backends = this.backends()
+	stats.SessionErrors = atomic.LoadUint64(&this.sessionErrors)
+	stats.RouteDrops = this.routing.drops()
+
+	if this.acl != nil {
+		aclStats := this.acl.Stats()
+		stats.Acl = &aclStats
+	}
+
+	return stats
+}
+
+/**
+ * Remember live backends for stats, called from server loop
+ */
+func (this *Server) setBackendsSnapshot(backends []core.Backend) {
+	this.backendsLock.Lock()
+	defer this.backendsLock.Unlock()
+
+	this.backendsSnapshot = backends
+}
+
+/**
+ * Live backends with their labels and stats
+ */
+func (this *Server) backends() []core.Backend {
+	this.backendsLock.RLock()
+	defer this.backendsLock.RUnlock()
+
+	return append([]core.Backend{}, this.backendsSnapshot...)
+}
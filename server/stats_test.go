@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"../config"
+	"../utils/aead"
+)
+
+func newTestServer(t *testing.T, cfg config.Server) *Server {
+	cfg.Bind = "127.0.0.1:0"
+	cfg.Balance = "roundrobin"
+	cfg.Discovery = &config.DiscoveryConfig{
+		Kind:                  "static",
+		StaticDiscoveryConfig: &config.StaticDiscoveryConfig{StaticList: []string{"127.0.0.1:4000"}},
+	}
+	cfg.Healthcheck = &config.HealthcheckConfig{Kind: "ping"}
+
+	server, err := New("test", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestStatsAfterFailedDecrypt(t *testing.T) {
+	server := newTestServer(t, config.Server{
+		Crypto: &config.CryptoConfig{Key: "hex:4242424242424242424242424242424242424242424242424242424242424242"},
+	})
+
+	other, err := aead.New("", bytes.Repeat([]byte{0x43}, 32), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientAddr := net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	if _, _, err := server.openClientPacket(clientAddr, nil, other.Channel().Seal([]byte("packet"))); err == nil {
+		t.Fatal("packet of other key is decrypted")
+	}
+	// zero channel id was created too long ago
+	if _, _, err := server.openClientPacket(clientAddr, nil, make([]byte, 64)); err == nil {
+		t.Fatal("garbage packet is decrypted")
+	}
+
+	stats := server.Stats().Crypto["listener"]
+	if stats.AuthFailures != 1 || stats.Expired != 1 {
+		t.Fatalf("listener stats %+v", stats)
+	}
+
+	// same counters are served over http
+	recorder := httptest.NewRecorder()
+	server.statsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/stats", nil))
+	if recorder.Code != 200 || recorder.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("response %d %v", recorder.Code, recorder.Header())
+	}
+
+	var served struct {
+		Crypto map[string]struct {
+			AuthFailures uint64 `json:"auth_failures"`
+		} `json:"crypto"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&served); err != nil {
+		t.Fatal(err)
+	}
+	if served.Crypto["listener"].AuthFailures != 1 {
+		t.Fatalf("served stats %+v", served)
+	}
+
+	recorder = httptest.NewRecorder()
+	server.statsHandler().ServeHTTP(recorder, httptest.NewRequest("POST", "/stats", nil))
+	if recorder.Code != 405 {
+		t.Fatalf("post response %d", recorder.Code)
+	}
+}
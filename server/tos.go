@@ -0,0 +1,105 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"sync"
+
+	"../core"
+	"../utils/ecn"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/**
+ * Outer TOS marking of backend socket.
+ * Either copies inner DSCP or sets fixed one,
+ * ECN is propagated per RFC 6040
+ */
+type marker struct {
+	sync.Mutex
+
+	/* Copy inner DSCP to outer header */
+	copy bool
+
+	/* Fixed outer DSCP if not copy */
+	dscp int
+
+	/* Last TOS set on socket, -1 if none yet */
+	last int
+
+	/* Sets TOS or traffic class by socket family */
+	setTos func(int) error
+}
+
+/**
+ * Creates marker for backend, nil if marking is not configured
+ */
+func newMarker(backend *core.Backend) *marker {
+
+	switch backend.Dscp {
+	case "":
+		return nil
+	case "copy":
+		return &marker{copy: true, last: -1}
+	}
+
+	dscp, err := strconv.Atoi(backend.Dscp)
+	if err != nil {
+		return nil
+	}
+
+	return &marker{dscp: dscp, last: -1}
+}
+
+/**
+ * Bind marker to backend connection
+ */
+func (this *marker) attach(conn *net.UDPConn) error {
+	ipv6Socket := isIPv6(conn)
+	if ipv6Socket {
+		this.setTos = ipv6.NewConn(conn).SetTrafficClass
+	} else {
+		this.setTos = ipv4.NewConn(conn).SetTOS
+	}
+	return enableRecvTos(conn, ipv6Socket)
+}
+
+/**
+ * Check if connection goes to IPv6 address
+ */
+func isIPv6(conn *net.UDPConn) bool {
+	addr, ok := conn.RemoteAddr().(*net.UDPAddr)
+	return ok && addr.IP.To4() == nil
+}
+
+/**
+ * Outer TOS for packet with inner TOS
+ */
+func (this *marker) tos(inner int) int {
+	if this.copy {
+		return ecn.Encap(inner, inner>>2)
+	}
+	return ecn.Encap(inner, this.dscp)
+}
+
+/**
+ * Write to socket with outer TOS for inner TOS
+ */
+func (this *marker) write(conn *net.UDPConn, buf []byte, inner int) error {
+
+	tos := this.tos(inner)
+
+	this.Lock()
+	defer this.Unlock()
+
+	if tos != this.last {
+		if err := this.setTos(tos); err != nil {
+			return err
+		}
+		this.last = tos
+	}
+
+	_, err := conn.Write(buf)
+	return err
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+)
+
+/**
+ * Ask kernel for TOS (traffic class for IPv6 socket) of received packets
+ */
+func enableRecvTos(conn *net.UDPConn, ipv6 bool) error {
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVTCLASS, 1)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_RECVTOS, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return serr
+}
+
+/**
+ * Read packet with its TOS, -1 if TOS is unknown
+ */
+func readWithTos(conn *net.UDPConn, buf []byte, oob []byte) (int, int, error) {
+
+	n, oobn, _, _, err := conn.ReadMsgUDP(buf, oob)
+	if err != nil {
+		return n, -1, err
+	}
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return n, -1, nil
+	}
+
+	for _, m := range msgs {
+		if m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_TOS && len(m.Data) > 0 {
+			return n, int(m.Data[0]), nil
+		}
+		// traffic class is int in host byte order
+		if m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_TCLASS && len(m.Data) >= 4 {
+			return n, int(binary.NativeEndian.Uint32(m.Data[:4]) & 0xff), nil
+		}
+	}
+
+	return n, -1, nil
+}
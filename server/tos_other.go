@@ -0,0 +1,22 @@
+// +build !linux
+
+package server
+
+import (
+	"net"
+)
+
+/**
+ * Receiving TOS is supported on linux only
+ */
+func enableRecvTos(conn *net.UDPConn, ipv6 bool) error {
+	return nil
+}
+
+/**
+ * Read packet, TOS is always unknown
+ */
+func readWithTos(conn *net.UDPConn, buf []byte, oob []byte) (int, int, error) {
+	n, err := conn.Read(buf)
+	return n, -1, err
+}
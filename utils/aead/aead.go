@@ -0,0 +1,357 @@
+/**
+ * aead.go - authenticated encryption of tunneled packets with pre-shared keys
+ *
+ * Packet format:
+ *
+ * +----------------+--------------------+----------------------------+
+ * | channel id (16)| counter (8)        | ciphertext + tag (16)      |
+ * +----------------+--------------------+----------------------------+
+ *
+ * Every sending channel has random id and encrypts with its own key
+ * derived from pre-shared key and id (HKDF), so many peers may share
+ * the same pre-shared key without nonce reuse. Counter is the nonce
+ * and is used for anti-replay.
+ *
+ * Id starts with channel creation time. Channels switch to a new id
+ * after CHANNEL_LIFETIME, receivers reject expired ids and keep replay
+ * window of every id until it expires, so packets can't be replayed
+ * once the receiving flow is gone.
+ */
+package aead
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"../window"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	ID_LEN      = 16
+	COUNTER_LEN = 8
+	NONCE_LEN   = 12
+	TAG_LEN     = 16
+	OVERHEAD    = ID_LEN + COUNTER_LEN + TAG_LEN
+
+	DEFAULT_REPLAY_WINDOW = 1024
+
+	/* Sending channel switches to new id after lifetime */
+	CHANNEL_LIFETIME = 10 * time.Minute
+
+	/* Tolerated difference of peers clocks */
+	MAX_CLOCK_SKEW = 2 * time.Minute
+
+	/* Max receiving channel ids remembered by cipher */
+	MAX_CHANNELS = 65536
+)
+
+var (
+	ErrShortPacket = errors.New("Packet is too short to be encrypted")
+	ErrAuth        = errors.New("Packet authentication failed")
+	ErrReplay      = errors.New("Replayed packet")
+	ErrExpired     = errors.New("Expired channel id")
+	ErrTooMany     = errors.New("Too many channels")
+)
+
+/**
+ * Cipher with pre-shared key, shared by all channels using the key.
+ * Keeps replay windows of received channel ids
+ */
+type Cipher struct {
+	kind string
+	key  []byte
+
+	replayWindow int
+
+	mutex     sync.Mutex
+	peers     map[[ID_LEN]byte]*peer
+	lastPrune time.Time
+
+	/* Counters */
+	authFailures uint64
+	replays      uint64
+	expired      uint64
+}
+
+/**
+ * Receiving state of channel id
+ */
+type peer struct {
+	aead    cipher.AEAD
+	replay  *window.Window
+	expires time.Time
+}
+
+/**
+ * Cipher counters
+ */
+type Stats struct {
+	AuthFailures uint64 `json:"auth_failures"`
+	Replays      uint64 `json:"replays"`
+	Expired      uint64 `json:"expired"`
+	Channels     int    `json:"channels"`
+}
+
+/**
+ * Creates cipher of kind with key
+ * Supported kinds: chacha20poly1305, aes-gcm
+ */
+func New(kind string, key []byte, replayWindow int) (*Cipher, error) {
+
+	if kind == "" {
+		kind = "chacha20poly1305"
+	}
+
+	// check kind and key
+	if _, err := newAead(kind, key); err != nil {
+		return nil, err
+	}
+
+	if replayWindow <= 0 {
+		replayWindow = DEFAULT_REPLAY_WINDOW
+	}
+
+	return &Cipher{
+		kind:         kind,
+		key:          key,
+		replayWindow: replayWindow,
+		peers:        make(map[[ID_LEN]byte]*peer),
+		lastPrune:    time.Now(),
+	}, nil
+}
+
+func newAead(kind string, key []byte) (cipher.AEAD, error) {
+	switch kind {
+	case "chacha20poly1305":
+		return chacha20poly1305.New(key)
+	case "aes-gcm":
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	default:
+		return nil, errors.New("Unknown cipher " + kind)
+	}
+}
+
+/**
+ * Derive key of channel id from pre-shared key
+ */
+func (this *Cipher) channelAead(id [ID_LEN]byte) cipher.AEAD {
+	key := make([]byte, len(this.key))
+	io.ReadFull(hkdf.New(sha256.New, this.key, id[:], []byte("mptun channel")), key)
+
+	// kind and key length are checked in New
+	aead, _ := newAead(this.kind, key)
+	return aead
+}
+
+/**
+ * Load key from string prefixed by its encoding, `hex:` or `base64:`,
+ * or from file if key is empty
+ */
+func LoadKey(key string, keyFile string) ([]byte, error) {
+
+	if key == "" && keyFile != "" {
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = string(data)
+	}
+
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return nil, errors.New("Empty key")
+	}
+
+	// encodings are ambiguous, base64 key may look like hex one
+	switch {
+	case strings.HasPrefix(key, "hex:"):
+		return hex.DecodeString(strings.TrimPrefix(key, "hex:"))
+	case strings.HasPrefix(key, "base64:"):
+		return base64.StdEncoding.DecodeString(strings.TrimPrefix(key, "base64:"))
+	default:
+		return nil, errors.New("Key should start with hex: or base64:")
+	}
+}
+
+/**
+ * Get cipher counters
+ */
+func (this *Cipher) Stats() Stats {
+	this.mutex.Lock()
+	channels := len(this.peers)
+	this.mutex.Unlock()
+
+	return Stats{
+		AuthFailures: atomic.LoadUint64(&this.authFailures),
+		Replays:      atomic.LoadUint64(&this.replays),
+		Expired:      atomic.LoadUint64(&this.expired),
+		Channels:     channels,
+	}
+}
+
+/**
+ * Authenticate, check for replay and decrypt packet of any channel
+ */
+func (this *Cipher) Open(packet []byte) ([]byte, error) {
+
+	if len(packet) < OVERHEAD {
+		atomic.AddUint64(&this.authFailures, 1)
+		return nil, ErrShortPacket
+	}
+
+	var id [ID_LEN]byte
+	copy(id[:], packet[:ID_LEN])
+	counter := binary.BigEndian.Uint64(packet[ID_LEN : ID_LEN+COUNTER_LEN])
+
+	now := time.Now()
+	created := time.Unix(int64(binary.BigEndian.Uint64(id[0:8])), 0)
+	if created.After(now.Add(MAX_CLOCK_SKEW)) || now.After(created.Add(CHANNEL_LIFETIME+MAX_CLOCK_SKEW)) {
+		atomic.AddUint64(&this.expired, 1)
+		return nil, ErrExpired
+	}
+
+	this.mutex.Lock()
+	p, known := this.peers[id]
+	this.mutex.Unlock()
+
+	if !known {
+		p = &peer{
+			aead:    this.channelAead(id),
+			replay:  window.New(this.replayWindow),
+			expires: created.Add(CHANNEL_LIFETIME + MAX_CLOCK_SKEW),
+		}
+	}
+
+	var nonce [NONCE_LEN]byte
+	binary.BigEndian.PutUint64(nonce[NONCE_LEN-COUNTER_LEN:], counter)
+
+	plaintext, err := p.aead.Open(nil, nonce[:], packet[ID_LEN+COUNTER_LEN:], nil)
+	if err != nil {
+		atomic.AddUint64(&this.authFailures, 1)
+		return nil, ErrAuth
+	}
+
+	// remember only authenticated ids
+	if !known {
+		if p, err = this.addPeer(id, p, now); err != nil {
+			return nil, err
+		}
+	}
+
+	if !p.replay.Accept(counter) {
+		atomic.AddUint64(&this.replays, 1)
+		return nil, ErrReplay
+	}
+
+	return plaintext, nil
+}
+
+/**
+ * Remember receiving state of channel id, returns state
+ * already added by concurrent packet if any
+ */
+func (this *Cipher) addPeer(id [ID_LEN]byte, p *peer, now time.Time) (*peer, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if existing, ok := this.peers[id]; ok {
+		return existing, nil
+	}
+
+	if now.Sub(this.lastPrune) > time.Minute || len(this.peers) >= MAX_CHANNELS {
+		this.lastPrune = now
+		for k, v := range this.peers {
+			if now.After(v.expires) {
+				delete(this.peers, k)
+			}
+		}
+	}
+
+	if len(this.peers) >= MAX_CHANNELS {
+		return nil, ErrTooMany
+	}
+
+	this.peers[id] = p
+	return p, nil
+}
+
+/**
+ * Sending channel of peer, keeps id, derived key and counter
+ */
+type Channel struct {
+	cipher *Cipher
+
+	mutex   sync.Mutex
+	id      [ID_LEN]byte
+	aead    cipher.AEAD
+	counter uint64
+	created time.Time
+}
+
+/**
+ * Creates new channel using cipher
+ */
+func (this *Cipher) Channel() *Channel {
+	c := &Channel{cipher: this}
+	c.rotate(time.Now())
+	return c
+}
+
+/**
+ * Switch to new id and key
+ */
+func (this *Channel) rotate(now time.Time) {
+	binary.BigEndian.PutUint64(this.id[0:8], uint64(now.Unix()))
+	rand.Read(this.id[8:])
+
+	this.aead = this.cipher.channelAead(this.id)
+	this.counter = 0
+	this.created = now
+}
+
+/**
+ * Encrypt packet
+ */
+func (this *Channel) Seal(plaintext []byte) []byte {
+	this.mutex.Lock()
+	if now := time.Now(); now.Sub(this.created) >= CHANNEL_LIFETIME {
+		this.rotate(now)
+	}
+	this.counter++
+	id, aead, counter := this.id, this.aead, this.counter
+	this.mutex.Unlock()
+
+	packet := make([]byte, ID_LEN+COUNTER_LEN, OVERHEAD+len(plaintext))
+	copy(packet[:ID_LEN], id[:])
+	binary.BigEndian.PutUint64(packet[ID_LEN:], counter)
+
+	var nonce [NONCE_LEN]byte
+	binary.BigEndian.PutUint64(nonce[NONCE_LEN-COUNTER_LEN:], counter)
+
+	return aead.Seal(packet, nonce[:], plaintext, nil)
+}
+
+/**
+ * Authenticate, check for replay and decrypt packet
+ */
+func (this *Channel) Open(packet []byte) ([]byte, error) {
+	return this.cipher.Open(packet)
+}
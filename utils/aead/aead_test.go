@@ -0,0 +1,196 @@
+package aead
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+var testKey = bytes.Repeat([]byte{0x42}, 32)
+
+func newTestCipher(t *testing.T, kind string) *Cipher {
+	c, err := New(kind, testKey, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestSealOpen(t *testing.T) {
+	for _, kind := range []string{"chacha20poly1305", "aes-gcm"} {
+		sender := newTestCipher(t, kind).Channel()
+		receiver := newTestCipher(t, kind)
+
+		packet := sender.Seal([]byte("payload"))
+		if len(packet) != OVERHEAD+len("payload") {
+			t.Fatalf("%s: sealed length %d", kind, len(packet))
+		}
+
+		plaintext, err := receiver.Open(packet)
+		if err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+		if string(plaintext) != "payload" {
+			t.Fatalf("%s: opened %q", kind, plaintext)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New("rc4", testKey, 0); err == nil {
+		t.Fatal("no error for unknown cipher")
+	}
+	if _, err := New("chacha20poly1305", testKey[:16], 0); err == nil {
+		t.Fatal("no error for short key")
+	}
+}
+
+func TestOpenRejects(t *testing.T) {
+	sender := newTestCipher(t, "").Channel()
+	receiver := newTestCipher(t, "")
+
+	packet := sender.Seal([]byte("payload"))
+
+	tampered := append([]byte{}, packet...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := receiver.Open(tampered); err != ErrAuth {
+		t.Fatalf("tampered: %v", err)
+	}
+
+	// counter is authenticated as nonce
+	tampered = append([]byte{}, packet...)
+	tampered[ID_LEN+COUNTER_LEN-1] ^= 1
+	if _, err := receiver.Open(tampered); err != ErrAuth {
+		t.Fatalf("tampered counter: %v", err)
+	}
+
+	if _, err := receiver.Open(packet[:OVERHEAD-1]); err != ErrShortPacket {
+		t.Fatalf("short: %v", err)
+	}
+
+	// other key
+	other, _ := New("", bytes.Repeat([]byte{0x43}, 32), 0)
+	if _, err := other.Open(packet); err != ErrAuth {
+		t.Fatalf("other key: %v", err)
+	}
+
+	if _, err := receiver.Open(packet); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiver.Open(packet); err != ErrReplay {
+		t.Fatalf("replay: %v", err)
+	}
+
+	stats := receiver.Stats()
+	if stats.AuthFailures != 3 || stats.Replays != 1 || stats.Channels != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestReplayWindowEdges(t *testing.T) {
+	sender := newTestCipher(t, "").Channel()
+	receiver := newTestCipher(t, "")
+
+	packets := make([][]byte, 100)
+	for i := range packets {
+		packets[i] = sender.Seal([]byte{byte(i)})
+	}
+
+	// newest first, then older ones inside and outside of window of 64
+	if _, err := receiver.Open(packets[99]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiver.Open(packets[99-63]); err != nil {
+		t.Fatalf("oldest packet in window: %v", err)
+	}
+	if _, err := receiver.Open(packets[99-64]); err != ErrReplay {
+		t.Fatalf("packet behind window: %v", err)
+	}
+}
+
+func TestChannelsOfSharedKey(t *testing.T) {
+	cipher := newTestCipher(t, "")
+	first, second := cipher.Channel(), cipher.Channel()
+	receiver := newTestCipher(t, "")
+
+	// both channels start with counter 1, but use different keys
+	for _, c := range []*Channel{first, second} {
+		if _, err := receiver.Open(c.Seal([]byte("payload"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if receiver.Stats().Channels != 2 {
+		t.Fatalf("channels %d", receiver.Stats().Channels)
+	}
+}
+
+func TestChannelLifetime(t *testing.T) {
+	receiver := newTestCipher(t, "")
+
+	// expired id is rejected even with valid key
+	expired := newTestCipher(t, "").Channel()
+	expired.rotate(time.Now().Add(-CHANNEL_LIFETIME - MAX_CLOCK_SKEW - time.Minute))
+	expired.created = time.Now()
+	if _, err := receiver.Open(expired.Seal([]byte("payload"))); err != ErrExpired {
+		t.Fatalf("expired: %v", err)
+	}
+
+	// id from future is rejected
+	future := newTestCipher(t, "").Channel()
+	future.rotate(time.Now().Add(MAX_CLOCK_SKEW + time.Minute))
+	if _, err := receiver.Open(future.Seal([]byte("payload"))); err != ErrExpired {
+		t.Fatalf("future: %v", err)
+	}
+
+	// sender switches to new id after lifetime
+	c := newTestCipher(t, "").Channel()
+	c.created = time.Now().Add(-CHANNEL_LIFETIME)
+	old := c.id
+	packet := c.Seal([]byte("payload"))
+	if bytes.Equal(packet[:ID_LEN], old[:]) || binary.BigEndian.Uint64(packet[ID_LEN:]) != 1 {
+		t.Fatal("channel is not rotated")
+	}
+	if _, err := receiver.Open(packet); err != nil {
+		t.Fatal(err)
+	}
+
+	if receiver.Stats().Expired != 2 {
+		t.Fatalf("stats %+v", receiver.Stats())
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	hexKey, err := LoadKey("hex:00112233", "")
+	if err != nil || !bytes.Equal(hexKey, []byte{0x00, 0x11, 0x22, 0x33}) {
+		t.Fatalf("hex key %x: %v", hexKey, err)
+	}
+
+	// base64 key made of hex characters is not decoded as hex
+	b64Key, err := LoadKey("base64:00112233", "")
+	if err != nil || len(b64Key) != 6 {
+		t.Fatalf("base64 key %x: %v", b64Key, err)
+	}
+
+	if _, err := LoadKey("00112233", ""); err == nil {
+		t.Fatal("no error for key without encoding")
+	}
+	if _, err := LoadKey("", ""); err == nil {
+		t.Fatal("no error for empty key")
+	}
+
+	f, err := ioutil.TempFile("", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("hex:ff\n")
+	f.Close()
+
+	fileKey, err := LoadKey("", f.Name())
+	if err != nil || !bytes.Equal(fileKey, []byte{0xff}) {
+		t.Fatalf("file key %x: %v", fileKey, err)
+	}
+}
@@ -0,0 +1,110 @@
+/**
+ * cookie.go - stateless cookies bound to client address
+ */
+package cookie
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"../ratelimit"
+)
+
+const (
+	COOKIE_LEN = 16
+
+	DEFAULT_SECRET_LIFETIME = 2 * time.Minute
+)
+
+/**
+ * Cookie checker, rotates secret periodically and
+ * accepts cookies made with current or previous one
+ */
+type Checker struct {
+	sync.Mutex
+
+	lifetime time.Duration
+
+	/* Rate of packets admitted without cookie, nil if cookie is always required */
+	load *ratelimit.Bucket
+
+	/* Clock, replaced in tests */
+	now func() time.Time
+
+	current  []byte
+	previous []byte
+	rotated  time.Time
+}
+
+/**
+ * Creates new checker with secret lifetime and load threshold
+ * in packets per second, zero threshold always requires cookie
+ */
+func New(lifetime time.Duration, threshold float64) *Checker {
+	if lifetime <= 0 {
+		lifetime = DEFAULT_SECRET_LIFETIME
+	}
+	c := &Checker{lifetime: lifetime, now: time.Now}
+	if threshold > 0 {
+		c.load = ratelimit.New(threshold, 0)
+	}
+	c.rotate(c.now())
+	return c
+}
+
+/**
+ * Check if packet of unknown client without valid cookie must be
+ * challenged. Below threshold such packets are admitted without
+ * cookie, so cookies are only required when server is under load
+ */
+func (this *Checker) Required() bool {
+	return this.load == nil || !this.load.Allow()
+}
+
+/**
+ * Make cookie for client address
+ */
+func (this *Checker) Make(addr string) []byte {
+	current, _ := this.secrets()
+	return mac(current, addr)
+}
+
+/**
+ * Check cookie of client address
+ */
+func (this *Checker) Valid(addr string, cookie []byte) bool {
+	current, previous := this.secrets()
+	if hmac.Equal(cookie, mac(current, addr)) {
+		return true
+	}
+	return previous != nil && hmac.Equal(cookie, mac(previous, addr))
+}
+
+func (this *Checker) secrets() ([]byte, []byte) {
+	this.Lock()
+	defer this.Unlock()
+
+	now := this.now()
+	if now.Sub(this.rotated) >= this.lifetime {
+		this.rotate(now)
+	}
+
+	return this.current, this.previous
+}
+
+func (this *Checker) rotate(now time.Time) {
+	secret := make([]byte, sha256.Size)
+	rand.Read(secret)
+	this.previous = this.current
+	this.current = secret
+	this.rotated = now
+}
+
+func mac(secret []byte, addr string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(addr))
+	return h.Sum(nil)[:COOKIE_LEN]
+}
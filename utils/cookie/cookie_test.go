@@ -0,0 +1,83 @@
+package cookie
+
+import (
+	"testing"
+	"time"
+)
+
+/**
+ * Checker with clock moved by test
+ */
+func newTestChecker(lifetime time.Duration, threshold float64) (*Checker, *time.Time) {
+	now := time.Now()
+	c := New(lifetime, threshold)
+	c.now = func() time.Time { return now }
+	c.rotated = now
+	return c, &now
+}
+
+func TestMakeValid(t *testing.T) {
+	c, _ := newTestChecker(time.Minute, 0)
+
+	cookie := c.Make("192.0.2.1:4000")
+	if len(cookie) != COOKIE_LEN {
+		t.Fatalf("cookie length %d", len(cookie))
+	}
+	if !c.Valid("192.0.2.1:4000", cookie) {
+		t.Fatal("cookie of same address is not valid")
+	}
+	if c.Valid("192.0.2.1:4001", cookie) {
+		t.Fatal("cookie of other address is valid")
+	}
+	if c.Valid("192.0.2.1:4000", cookie[:COOKIE_LEN-1]) {
+		t.Fatal("truncated cookie is valid")
+	}
+
+	other, _ := newTestChecker(time.Minute, 0)
+	if other.Valid("192.0.2.1:4000", cookie) {
+		t.Fatal("cookie of other checker is valid")
+	}
+}
+
+func TestSecretRotation(t *testing.T) {
+	c, now := newTestChecker(time.Minute, 0)
+	addr := "192.0.2.1:4000"
+
+	cookie := c.Make(addr)
+
+	// previous secret is still accepted after one rotation
+	*now = now.Add(time.Minute)
+	if !c.Valid(addr, cookie) {
+		t.Fatal("cookie of previous secret is not valid")
+	}
+	fresh := c.Make(addr)
+	if string(fresh) == string(cookie) {
+		t.Fatal("secret was not rotated")
+	}
+
+	*now = now.Add(time.Minute)
+	if c.Valid(addr, cookie) {
+		t.Fatal("cookie is valid after two rotations")
+	}
+	if !c.Valid(addr, fresh) {
+		t.Fatal("cookie of previous secret is not valid")
+	}
+}
+
+func TestThreshold(t *testing.T) {
+	c, _ := newTestChecker(time.Minute, 0)
+	if !c.Required() {
+		t.Fatal("cookie is not required without threshold")
+	}
+
+	// unknown clients are admitted without cookie until threshold
+	c, _ = newTestChecker(time.Minute, 3)
+	for i := 0; i < 3; i++ {
+		if c.Required() {
+			t.Fatalf("cookie is required below threshold, packet %d", i)
+		}
+	}
+	if !c.Required() {
+		t.Fatal("cookie is not required above threshold")
+	}
+}
@@ -0,0 +1,58 @@
+/**
+ * dial.go - connect to target with its local binding
+ */
+package dial
+
+import (
+	"net"
+	"syscall"
+
+	"../../core"
+)
+
+/**
+ * Connect UDP socket to target, binding it to target
+ * source address, interface and firewall mark if set
+ */
+func UDP(target core.Target) (*net.UDPConn, error) {
+
+	dialer := net.Dialer{}
+
+	if target.Source != "" {
+		addr, err := net.ResolveUDPAddr("udp", sourceAddress(target.Source))
+		if err != nil {
+			return nil, err
+		}
+		dialer.LocalAddr = addr
+	}
+
+	if target.Interface != "" || target.Mark != 0 {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = bind(fd, target.Interface, target.Mark)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+
+	conn, err := dialer.Dial("udp", target.Address())
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.UDPConn), nil
+}
+
+/**
+ * Source is either ip or ip:port
+ */
+func sourceAddress(source string) string {
+	if _, _, err := net.SplitHostPort(source); err == nil {
+		return source
+	}
+	return net.JoinHostPort(source, "0")
+}
@@ -0,0 +1,25 @@
+package dial
+
+import (
+	"syscall"
+)
+
+/**
+ * Bind socket to interface and set firewall mark
+ */
+func bind(fd uintptr, iface string, mark int) error {
+
+	if iface != "" {
+		if err := syscall.BindToDevice(int(fd), iface); err != nil {
+			return err
+		}
+	}
+
+	if mark != 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
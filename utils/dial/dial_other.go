@@ -0,0 +1,14 @@
+// +build !linux
+
+package dial
+
+import (
+	"errors"
+)
+
+/**
+ * Interface binding and firewall marks are supported on linux only
+ */
+func bind(fd uintptr, iface string, mark int) error {
+	return errors.New("interface and mark are not supported on this platform")
+}
@@ -0,0 +1,65 @@
+/**
+ * ecn.go - ECN propagation between inner and outer headers, RFC 6040
+ */
+package ecn
+
+import (
+	"encoding/binary"
+
+	"../packet"
+)
+
+const (
+	NOT_ECT = 0
+	ECT_1   = 1
+	ECT_0   = 2
+	CE      = 3
+
+	IPV4_HEADER_LEN = 20
+)
+
+/**
+ * Outer TOS for encapsulation of packet with inner TOS.
+ * ECN field is copied (normal mode), DSCP is given
+ */
+func Encap(inner int, dscp int) int {
+	return (dscp&0x3f)<<2 | inner&0x03
+}
+
+/**
+ * Apply ECN field of outer TOS to inner IPv4 packet in place,
+ * fixing header checksum. Returns false if packet must be dropped.
+ * Negative outer means unknown and leaves packet untouched
+ */
+func Decap(outer int, buf []byte) bool {
+
+	if outer < 0 || len(buf) < IPV4_HEADER_LEN || buf[0]>>4 != 4 {
+		return true
+	}
+
+	inner := int(buf[1] & 0x03)
+	result := inner
+
+	switch outer & 0x03 {
+	case CE:
+		if inner == NOT_ECT {
+			return false
+		}
+		result = CE
+	case ECT_1:
+		if inner == ECT_0 {
+			result = ECT_1
+		}
+	}
+
+	if result == inner {
+		return true
+	}
+
+	old := binary.BigEndian.Uint16(buf[0:2])
+	buf[1] = buf[1]&^0x03 | byte(result)
+	checksum := binary.BigEndian.Uint16(buf[10:12])
+	binary.BigEndian.PutUint16(buf[10:12], packet.UpdateChecksum(checksum, old, binary.BigEndian.Uint16(buf[0:2])))
+
+	return true
+}
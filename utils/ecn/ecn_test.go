@@ -0,0 +1,103 @@
+package ecn
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+/**
+ * IPv4 header with tos and valid checksum
+ */
+func testPacket(tos int) []byte {
+	buf := make([]byte, IPV4_HEADER_LEN+8)
+	buf[0] = 0x45
+	buf[1] = byte(tos)
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(buf)))
+	binary.BigEndian.PutUint16(buf[4:6], 0x1234)
+	buf[8] = 64
+	buf[9] = 17
+	copy(buf[12:16], []byte{10, 0, 0, 1})
+	copy(buf[16:20], []byte{10, 0, 0, 2})
+	binary.BigEndian.PutUint16(buf[10:12], checksum(buf[:IPV4_HEADER_LEN]))
+	return buf
+}
+
+/**
+ * Full header checksum, zero for header with valid one
+ */
+func checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i : i+2]))
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+func TestEncap(t *testing.T) {
+	// dscp is set, ecn of inner is copied
+	for inner := NOT_ECT; inner <= CE; inner++ {
+		if outer := Encap(46<<2|inner, 10); outer != 10<<2|inner {
+			t.Errorf("inner ecn %d: outer tos %#x", inner, outer)
+		}
+	}
+	if outer := Encap(ECT_0, 0x7f); outer != 0x3f<<2|ECT_0 {
+		t.Errorf("dscp is not masked, outer tos %#x", outer)
+	}
+}
+
+func TestDecap(t *testing.T) {
+	const drop = -1
+
+	// RFC 6040 section 4.2, rows are inner, columns are outer
+	table := [4][4]int{
+		NOT_ECT: {NOT_ECT, NOT_ECT, NOT_ECT, drop},
+		ECT_1:   {ECT_1, ECT_1, ECT_1, CE},
+		ECT_0:   {ECT_0, ECT_1, ECT_0, CE},
+		CE:      {CE, CE, CE, CE},
+	}
+
+	for inner := range table {
+		for outer, expected := range table[inner] {
+			buf := testPacket(46<<2 | inner)
+
+			ok := Decap(8<<2|outer, buf)
+			if expected == drop {
+				if ok {
+					t.Errorf("inner %d, outer %d: not dropped", inner, outer)
+				}
+				continue
+			}
+			if !ok {
+				t.Errorf("inner %d, outer %d: dropped", inner, outer)
+				continue
+			}
+			if int(buf[1]) != 46<<2|expected {
+				t.Errorf("inner %d, outer %d: tos %#x, expected ecn %d", inner, outer, buf[1], expected)
+			}
+			if checksum(buf[:IPV4_HEADER_LEN]) != 0 {
+				t.Errorf("inner %d, outer %d: bad checksum", inner, outer)
+			}
+		}
+	}
+}
+
+func TestDecapUntouched(t *testing.T) {
+	buf := testPacket(ECT_0)
+	if !Decap(-1, buf) || buf[1] != ECT_0 {
+		t.Fatal("unknown outer tos changed packet")
+	}
+
+	short := []byte{0x45, 0}
+	if !Decap(CE, short) || short[1] != 0 {
+		t.Fatal("truncated packet changed")
+	}
+
+	v6 := testPacket(NOT_ECT)
+	v6[0] = 0x60
+	if !Decap(CE, v6) {
+		t.Fatal("non IPv4 packet dropped")
+	}
+}
@@ -0,0 +1,452 @@
+/**
+ * fec.go - Reed-Solomon forward error correction over packet groups
+ *
+ * Every K data packets with consecutive sequence numbers form a group,
+ * encoder generates M parity shards for it. Data shard is packet
+ * prefixed with its length and zero padded to the longest packet in group.
+ */
+package fec
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+const PARITY_HEADER_LEN = 8
+
+var ErrShortParity = errors.New("Parity packet is too short")
+
+/**
+ * Parity packet
+ */
+type Parity struct {
+
+	/* Sequence number of the first data packet in group */
+	Base uint32
+
+	/* Data and parity shards count in group */
+	K int
+	M int
+
+	/* Index of parity shard, 0..M-1 */
+	Index int
+
+	Shard []byte
+}
+
+/**
+ * Serialize parity packet
+ */
+func (p *Parity) Marshal() []byte {
+	b := make([]byte, PARITY_HEADER_LEN+len(p.Shard))
+	binary.BigEndian.PutUint32(b[0:4], p.Base)
+	b[4] = byte(p.K)
+	b[5] = byte(p.M)
+	b[6] = byte(p.Index)
+	copy(b[PARITY_HEADER_LEN:], p.Shard)
+	return b
+}
+
+/**
+ * Parse parity packet
+ */
+func ParseParity(b []byte) (*Parity, error) {
+	if len(b) <= PARITY_HEADER_LEN+2 {
+		return nil, ErrShortParity
+	}
+	p := &Parity{
+		Base:  binary.BigEndian.Uint32(b[0:4]),
+		K:     int(b[4]),
+		M:     int(b[5]),
+		Index: int(b[6]),
+		Shard: b[PARITY_HEADER_LEN:],
+	}
+	if p.K == 0 || p.M == 0 || p.Index >= p.M {
+		return nil, errors.New("Bad parity packet header")
+	}
+	return p, nil
+}
+
+/**
+ * Recovered data packet
+ */
+type Recovered struct {
+	Seq    uint32
+	Packet []byte
+}
+
+/**
+ * Cache of reed-solomon codecs by k and m
+ */
+type codecs struct {
+	sync.Mutex
+	encoders map[[2]int]reedsolomon.Encoder
+}
+
+func (this *codecs) get(k, m int) (reedsolomon.Encoder, error) {
+	this.Lock()
+	defer this.Unlock()
+
+	if this.encoders == nil {
+		this.encoders = make(map[[2]int]reedsolomon.Encoder)
+	}
+
+	key := [2]int{k, m}
+	if enc, ok := this.encoders[key]; ok {
+		return enc, nil
+	}
+
+	enc, err := reedsolomon.New(k, m)
+	if err != nil {
+		return nil, err
+	}
+	this.encoders[key] = enc
+	return enc, nil
+}
+
+/**
+ * Build data shards of given length
+ */
+func dataShard(packet []byte, length int) []byte {
+	shard := make([]byte, length)
+	binary.BigEndian.PutUint16(shard[0:2], uint16(len(packet)))
+	copy(shard[2:], packet)
+	return shard
+}
+
+/**
+ * Incomplete group on encoder side
+ */
+type group struct {
+	packets [][]byte
+	count   int
+	created time.Time
+}
+
+/**
+ * Encoder, collects data packets and emits parity
+ */
+type Encoder struct {
+	sync.Mutex
+	codecs
+
+	k         int
+	timeout   time.Duration
+	groups    map[uint32]*group
+	lastSweep time.Time
+
+	/* Groups are aligned on the first sequence number seen */
+	origin  uint32
+	started bool
+}
+
+/**
+ * Creates encoder for groups of k packets, incomplete
+ * groups are dropped after timeout
+ */
+func NewEncoder(k int, timeout time.Duration) *Encoder {
+	return &Encoder{
+		k:       k,
+		timeout: timeout,
+		groups:  make(map[uint32]*group),
+	}
+}
+
+/**
+ * Add sent data packet, returns m parity packets
+ * if packet completed its group
+ */
+func (this *Encoder) Add(seq uint32, packet []byte, m int) ([]*Parity, error) {
+	this.Lock()
+
+	now := time.Now()
+	this.sweep(now)
+
+	if !this.started {
+		this.started = true
+		this.origin = seq
+	}
+
+	base := seq - (seq-this.origin)%uint32(this.k)
+	g, ok := this.groups[base]
+	if !ok {
+		g = &group{packets: make([][]byte, this.k), created: now}
+		this.groups[base] = g
+	}
+
+	index := int(seq - base)
+	if g.packets[index] != nil {
+		this.Unlock()
+		return nil, nil
+	}
+
+	held := make([]byte, len(packet))
+	copy(held, packet)
+	g.packets[index] = held
+	g.count++
+
+	if g.count < this.k {
+		this.Unlock()
+		return nil, nil
+	}
+
+	delete(this.groups, base)
+	this.Unlock()
+
+	if m <= 0 {
+		return nil, nil
+	}
+
+	enc, err := this.get(this.k, m)
+	if err != nil {
+		return nil, err
+	}
+
+	length := 0
+	for _, p := range g.packets {
+		if len(p)+2 > length {
+			length = len(p) + 2
+		}
+	}
+
+	shards := make([][]byte, this.k+m)
+	for i, p := range g.packets {
+		shards[i] = dataShard(p, length)
+	}
+	for i := this.k; i < this.k+m; i++ {
+		shards[i] = make([]byte, length)
+	}
+
+	if err := enc.Encode(shards); err != nil {
+		return nil, err
+	}
+
+	parity := make([]*Parity, m)
+	for i := 0; i < m; i++ {
+		parity[i] = &Parity{
+			Base:  base,
+			K:     this.k,
+			M:     m,
+			Index: i,
+			Shard: shards[this.k+i],
+		}
+	}
+
+	return parity, nil
+}
+
+/**
+ * Drop expired incomplete groups, at most once per timeout
+ */
+func (this *Encoder) sweep(now time.Time) {
+	if now.Sub(this.lastSweep) < this.timeout {
+		return
+	}
+	this.lastSweep = now
+	for base, g := range this.groups {
+		if now.Sub(g.created) > this.timeout {
+			delete(this.groups, base)
+		}
+	}
+}
+
+/**
+ * Held data packet on decoder side
+ */
+type held struct {
+	packet  []byte
+	arrived time.Time
+}
+
+/**
+ * Parity shards of group on decoder side
+ */
+type parityGroup struct {
+	k, m    int
+	shards  [][]byte
+	arrived time.Time
+}
+
+/**
+ * Decoder, holds recent data packets and recovers lost
+ * ones when enough parity arrives
+ */
+type Decoder struct {
+	sync.Mutex
+	codecs
+
+	timeout   time.Duration
+	packets   map[uint32]held
+	groups    map[uint32]*parityGroup
+	done      map[uint32]time.Time
+	lastSweep time.Time
+}
+
+/**
+ * Creates decoder holding packets for timeout
+ */
+func NewDecoder(timeout time.Duration) *Decoder {
+	return &Decoder{
+		timeout: timeout,
+		packets: make(map[uint32]held),
+		groups:  make(map[uint32]*parityGroup),
+		done:    make(map[uint32]time.Time),
+	}
+}
+
+/**
+ * Add received data packet, returns packets recovered with it
+ */
+func (this *Decoder) AddData(seq uint32, packet []byte) []Recovered {
+	this.Lock()
+	defer this.Unlock()
+
+	now := time.Now()
+	this.sweep(now)
+
+	if _, ok := this.packets[seq]; ok {
+		return nil
+	}
+
+	h := held{make([]byte, len(packet)), now}
+	copy(h.packet, packet)
+	this.packets[seq] = h
+
+	for base, g := range this.groups {
+		if seq-base < uint32(g.k) {
+			return this.recover(base, g)
+		}
+	}
+
+	return nil
+}
+
+/**
+ * Add received parity packet, returns recovered packets
+ */
+func (this *Decoder) AddParity(p *Parity) []Recovered {
+	this.Lock()
+	defer this.Unlock()
+
+	now := time.Now()
+	this.sweep(now)
+
+	if _, ok := this.done[p.Base]; ok {
+		return nil
+	}
+
+	g, ok := this.groups[p.Base]
+	if !ok {
+		g = &parityGroup{k: p.K, m: p.M, shards: make([][]byte, p.M), arrived: now}
+		this.groups[p.Base] = g
+	}
+	if g.k != p.K || g.m != p.M || g.shards[p.Index] != nil {
+		return nil
+	}
+
+	g.shards[p.Index] = make([]byte, len(p.Shard))
+	copy(g.shards[p.Index], p.Shard)
+
+	return this.recover(p.Base, g)
+}
+
+/**
+ * Try to recover missing data packets of group
+ */
+func (this *Decoder) recover(base uint32, g *parityGroup) []Recovered {
+
+	length := 0
+	parity := 0
+	for _, s := range g.shards {
+		if s != nil {
+			length = len(s)
+			parity++
+		}
+	}
+
+	shards := make([][]byte, g.k+g.m)
+	missing := 0
+	for i := 0; i < g.k; i++ {
+		h, ok := this.packets[base+uint32(i)]
+		if !ok || len(h.packet)+2 > length {
+			missing++
+			continue
+		}
+		shards[i] = dataShard(h.packet, length)
+	}
+
+	if missing == 0 {
+		this.finish(base)
+		return nil
+	}
+
+	if g.k-missing+parity < g.k {
+		return nil
+	}
+
+	for i, s := range g.shards {
+		shards[g.k+i] = s
+	}
+
+	enc, err := this.get(g.k, g.m)
+	if err != nil {
+		return nil
+	}
+
+	if err := enc.ReconstructData(shards); err != nil {
+		return nil
+	}
+
+	var result []Recovered
+	now := time.Now()
+	for i := 0; i < g.k; i++ {
+		seq := base + uint32(i)
+		if _, ok := this.packets[seq]; ok {
+			continue
+		}
+		n := int(binary.BigEndian.Uint16(shards[i][0:2]))
+		if n+2 > len(shards[i]) {
+			continue
+		}
+		packet := shards[i][2 : 2+n]
+		this.packets[seq] = held{packet, now}
+		result = append(result, Recovered{seq, packet})
+	}
+
+	this.finish(base)
+	return result
+}
+
+func (this *Decoder) finish(base uint32) {
+	delete(this.groups, base)
+	this.done[base] = time.Now()
+}
+
+/**
+ * Drop expired packets and groups, at most once per timeout
+ */
+func (this *Decoder) sweep(now time.Time) {
+	if now.Sub(this.lastSweep) < this.timeout {
+		return
+	}
+	this.lastSweep = now
+	for seq, h := range this.packets {
+		if now.Sub(h.arrived) > this.timeout {
+			delete(this.packets, seq)
+		}
+	}
+	for base, g := range this.groups {
+		if now.Sub(g.arrived) > this.timeout {
+			delete(this.groups, base)
+		}
+	}
+	for base, t := range this.done {
+		if now.Sub(t) > this.timeout {
+			delete(this.done, base)
+		}
+	}
+}
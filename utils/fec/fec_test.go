@@ -0,0 +1,158 @@
+package fec
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+const (
+	testK = 4
+	testM = 3
+)
+
+/**
+ * Group of data packets of different length and their parity
+ */
+func testGroup(t *testing.T, first uint32) ([][]byte, []*Parity) {
+	enc := NewEncoder(testK, time.Second)
+
+	packets := make([][]byte, testK)
+	var parity []*Parity
+	for i := range packets {
+		packets[i] = bytes.Repeat([]byte{byte(i + 1)}, 10+i*7)
+		p, err := enc.Add(first+uint32(i), packets[i], testM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < testK-1 && p != nil {
+			t.Fatalf("parity before group is complete")
+		}
+		parity = p
+	}
+	if len(parity) != testM {
+		t.Fatalf("%d parity packets", len(parity))
+	}
+	for _, p := range parity {
+		if p.Base != first || p.K != testK || p.M != testM {
+			t.Fatalf("parity header %+v", p)
+		}
+	}
+
+	return packets, parity
+}
+
+func TestParityMarshal(t *testing.T) {
+	p := &Parity{Base: 0xfffffffe, K: testK, M: testM, Index: 2, Shard: []byte("shard")}
+
+	parsed, err := ParseParity(p.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Base != p.Base || parsed.K != p.K || parsed.M != p.M || parsed.Index != p.Index || !bytes.Equal(parsed.Shard, p.Shard) {
+		t.Fatalf("parsed %+v", parsed)
+	}
+
+	bad := p.Marshal()
+	bad[6] = testM
+	if _, err := ParseParity(bad); err == nil {
+		t.Fatal("no error for index out of group")
+	}
+	if _, err := ParseParity(bad[:PARITY_HEADER_LEN]); err != ErrShortParity {
+		t.Fatalf("short parity: %v", err)
+	}
+}
+
+func TestRecoverLostPackets(t *testing.T) {
+
+	const first = 100
+
+	for lost := 1; lost <= testM+1; lost++ {
+		t.Run(fmt.Sprint(lost, " lost"), func(t *testing.T) {
+			packets, parity := testGroup(t, first)
+			dec := NewDecoder(time.Second)
+
+			for i := lost; i < testK; i++ {
+				if r := dec.AddData(first+uint32(i), packets[i]); r != nil {
+					t.Fatalf("recovered %v without parity", r)
+				}
+			}
+
+			recovered := map[uint32][]byte{}
+			for _, p := range parity {
+				parsed, err := ParseParity(p.Marshal())
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, r := range dec.AddParity(parsed) {
+					recovered[r.Seq] = r.Packet
+				}
+			}
+
+			// more lost packets than parity can't be recovered
+			if lost > testM {
+				if len(recovered) != 0 {
+					t.Fatalf("recovered %d packets", len(recovered))
+				}
+				return
+			}
+
+			if len(recovered) != lost {
+				t.Fatalf("recovered %d packets, want %d", len(recovered), lost)
+			}
+			for i := 0; i < lost; i++ {
+				if !bytes.Equal(recovered[first+uint32(i)], packets[i]) {
+					t.Fatalf("packet %d recovered as %v", i, recovered[first+uint32(i)])
+				}
+			}
+		})
+	}
+}
+
+func TestRecoverOutOfOrder(t *testing.T) {
+
+	// group wraps around sequence numbers
+	const first = 0xfffffffe
+
+	packets, parity := testGroup(t, first)
+	dec := NewDecoder(time.Second)
+
+	// parity arrives before data, data in reverse order, packet 1 is lost
+	if r := dec.AddParity(parity[2]); r != nil {
+		t.Fatalf("recovered %v with parity only", r)
+	}
+	for _, i := range []int{3, 2} {
+		if r := dec.AddData(first+uint32(i), packets[i]); r != nil {
+			t.Fatalf("recovered %v too early", r)
+		}
+	}
+
+	r := dec.AddData(first, packets[0])
+	if len(r) != 1 || r[0].Seq != first+1 || !bytes.Equal(r[0].Packet, packets[1]) {
+		t.Fatalf("recovered %v", r)
+	}
+
+	// group is done, late parity recovers nothing
+	if r := dec.AddParity(parity[0]); r != nil {
+		t.Fatalf("recovered %v again", r)
+	}
+}
+
+func TestEncoderAlignsOnFirstSequence(t *testing.T) {
+	enc := NewEncoder(testK, time.Second)
+
+	for seq := uint32(7); seq < 7+2*testK; seq++ {
+		parity, err := enc.Add(seq, []byte{byte(seq)}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		complete := (seq-7)%testK == testK-1
+		if complete != (parity != nil) {
+			t.Fatalf("seq %d: parity %v", seq, parity)
+		}
+		if parity != nil && parity[0].Base != seq-testK+1 {
+			t.Fatalf("seq %d: group base %d", seq, parity[0].Base)
+		}
+	}
+}
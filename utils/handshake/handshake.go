@@ -0,0 +1,499 @@
+/**
+ * handshake.go - Noise IK handshake and transport between clients and mptun
+ *
+ * Messages (first byte is type):
+ *
+ * initiation: | 1 | sender index (4) | noise IK message 1 |
+ * response:   | 2 | sender index (4) | receiver index (4) | noise IK message 2 |
+ * transport:  | 4 | receiver index (4) | key phase (1) | counter (8) | ciphertext |
+ *
+ * Payload of initiation is TAI64N timestamp (12), responder accepts only
+ * initiations newer than the last one of the same peer key, so captured
+ * initiations can't be replayed. New session of peer replaces previous one.
+ *
+ * Each direction rotates its key with noise Rekey() after time or bytes
+ * threshold flipping key phase, so the flow is never interrupted.
+ */
+package handshake
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"../window"
+	"github.com/flynn/noise"
+)
+
+const (
+	TYPE_INITIATION = 1
+	TYPE_RESPONSE   = 2
+	TYPE_TRANSPORT  = 4
+
+	INITIATION_HEADER_LEN = 5
+	RESPONSE_HEADER_LEN   = 9
+	TRANSPORT_HEADER_LEN  = 14
+	TAG_LEN               = 16
+	TIMESTAMP_LEN         = 12
+	OVERHEAD              = TRANSPORT_HEADER_LEN + TAG_LEN
+
+	DEFAULT_REKEY_AFTER_TIME  = 2 * time.Minute
+	DEFAULT_REKEY_AFTER_BYTES = 1 << 30
+	DEFAULT_REPLAY_WINDOW     = 1024
+	DEFAULT_SESSION_TIMEOUT   = 5 * time.Minute
+)
+
+var (
+	ErrShortMessage   = errors.New("Message is too short")
+	ErrUnauthorized   = errors.New("Peer key is not authorized")
+	ErrUnknownSession = errors.New("Unknown session")
+	ErrAuth           = errors.New("Packet authentication failed")
+	ErrReplay         = errors.New("Replayed packet")
+	ErrBadTimestamp   = errors.New("Bad initiation timestamp")
+	ErrOldInitiation  = errors.New("Initiation is not newer than previous one")
+)
+
+var cipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+
+/**
+ * Type of message, 0 if empty
+ */
+func Type(packet []byte) byte {
+	if len(packet) == 0 {
+		return 0
+	}
+	return packet[0]
+}
+
+/**
+ * Rotate key, noise Rekey()
+ */
+func rekey(key [32]byte) [32]byte {
+	cs := noise.UnsafeNewCipherState(cipherSuite, key, 0)
+	cs.Rekey()
+	return cs.UnsafeKey()
+}
+
+/**
+ * TAI64N timestamp of time, payload of initiation
+ */
+func Timestamp(t time.Time) []byte {
+	b := make([]byte, TIMESTAMP_LEN)
+	binary.BigEndian.PutUint64(b[0:8], uint64(1<<62+t.Unix()))
+	binary.BigEndian.PutUint32(b[8:12], uint32(t.Nanosecond()))
+	return b
+}
+
+/**
+ * Responder options
+ */
+type Options struct {
+	RekeyAfterTime  time.Duration
+	RekeyAfterBytes uint64
+	ReplayWindow    int
+
+	/* Session without received packets is removed after timeout */
+	SessionTimeout time.Duration
+}
+
+/**
+ * Responder side of handshake, keeps established sessions
+ */
+type Responder struct {
+	sync.Mutex
+
+	static     noise.DHKey
+	authorized map[string]string
+	opts       Options
+
+	/* Sessions by local index */
+	sessions map[uint32]*Session
+
+	/* Latest initiation and session by peer static key */
+	peers map[string]*peer
+}
+
+/**
+ * Handshake state of peer static key
+ */
+type peer struct {
+	timestamp []byte
+	session   *Session
+}
+
+/**
+ * Creates new responder with static keypair and authorized peer keys
+ */
+func NewResponder(static noise.DHKey, authorized map[string]string, opts Options) *Responder {
+	if opts.RekeyAfterTime <= 0 {
+		opts.RekeyAfterTime = DEFAULT_REKEY_AFTER_TIME
+	}
+	if opts.RekeyAfterBytes == 0 {
+		opts.RekeyAfterBytes = DEFAULT_REKEY_AFTER_BYTES
+	}
+	if opts.ReplayWindow <= 0 {
+		opts.ReplayWindow = DEFAULT_REPLAY_WINDOW
+	}
+	if opts.SessionTimeout <= 0 {
+		opts.SessionTimeout = DEFAULT_SESSION_TIMEOUT
+	}
+
+	return &Responder{
+		static:     static,
+		authorized: authorized,
+		opts:       opts,
+		sessions:   make(map[uint32]*Session),
+		peers:      make(map[string]*peer),
+	}
+}
+
+/**
+ * Process initiation message, returns response message to send
+ * back and newly established session
+ */
+func (this *Responder) Handshake(message []byte) ([]byte, *Session, error) {
+
+	if len(message) <= INITIATION_HEADER_LEN || message[0] != TYPE_INITIATION {
+		return nil, nil, ErrShortMessage
+	}
+
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:   cipherSuite,
+		Random:        rand.Reader,
+		Pattern:       noise.HandshakeIK,
+		Initiator:     false,
+		StaticKeypair: this.static,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	timestamp, _, _, err := hs.ReadMessage(nil, message[INITIATION_HEADER_LEN:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	peerKey := string(hs.PeerStatic())
+	name, ok := this.authorized[peerKey]
+	if !ok {
+		return nil, nil, ErrUnauthorized
+	}
+
+	if len(timestamp) != TIMESTAMP_LEN {
+		return nil, nil, ErrBadTimestamp
+	}
+
+	session := &Session{
+		RemoteIndex: binary.BigEndian.Uint32(message[1:INITIATION_HEADER_LEN]),
+		Peer:        name,
+		PeerKey:     peerKey,
+		opts:        this.opts,
+		lastRecv:    time.Now().UnixNano(),
+	}
+
+	response := make([]byte, RESPONSE_HEADER_LEN)
+	response[0] = TYPE_RESPONSE
+	binary.BigEndian.PutUint32(response[5:9], session.RemoteIndex)
+
+	response, recv, send, err := hs.WriteMessage(response, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	session.send.init(send.UnsafeKey())
+	session.recv.init(recv.UnsafeKey(), this.opts.ReplayWindow)
+
+	this.Lock()
+	defer this.Unlock()
+
+	// timestamp is authenticated by peer static key
+	p, ok := this.peers[peerKey]
+	if !ok {
+		p = &peer{}
+		this.peers[peerKey] = p
+	}
+	if p.timestamp != nil && bytes.Compare(timestamp, p.timestamp) <= 0 {
+		return nil, nil, ErrOldInitiation
+	}
+	p.timestamp = timestamp
+
+	this.expire()
+
+	for {
+		var b [4]byte
+		rand.Read(b[:])
+		session.LocalIndex = binary.BigEndian.Uint32(b[:])
+		if _, exists := this.sessions[session.LocalIndex]; !exists && session.LocalIndex != 0 {
+			break
+		}
+	}
+
+	// one session per peer key, rehandshake replaces previous one
+	if p.session != nil {
+		delete(this.sessions, p.session.LocalIndex)
+	}
+	p.session = session
+	this.sessions[session.LocalIndex] = session
+
+	binary.BigEndian.PutUint32(response[1:5], session.LocalIndex)
+
+	return response, session, nil
+}
+
+/**
+ * Authenticate and decrypt transport message
+ */
+func (this *Responder) Open(packet []byte) (*Session, []byte, error) {
+
+	if len(packet) < OVERHEAD || packet[0] != TYPE_TRANSPORT {
+		return nil, nil, ErrShortMessage
+	}
+
+	this.Lock()
+	session, ok := this.sessions[binary.BigEndian.Uint32(packet[1:5])]
+	if ok && session.idle(this.opts.SessionTimeout) {
+		this.remove(session)
+		ok = false
+	}
+	this.Unlock()
+
+	if !ok {
+		return nil, nil, ErrUnknownSession
+	}
+
+	plaintext, err := session.Open(packet)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return session, plaintext, nil
+}
+
+/**
+ * Remove sessions without received packets for timeout, should be called locked
+ */
+func (this *Responder) expire() {
+	for _, session := range this.sessions {
+		if session.idle(this.opts.SessionTimeout) {
+			this.remove(session)
+		}
+	}
+}
+
+/**
+ * Forget session
+ */
+func (this *Responder) Remove(session *Session) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.remove(session)
+}
+
+func (this *Responder) remove(session *Session) {
+	if this.sessions[session.LocalIndex] == session {
+		delete(this.sessions, session.LocalIndex)
+	}
+	if p, ok := this.peers[session.PeerKey]; ok && p.session == session {
+		p.session = nil
+	}
+}
+
+/**
+ * Established session
+ */
+type Session struct {
+	LocalIndex  uint32
+	RemoteIndex uint32
+
+	/* Name and static key of authorized peer */
+	Peer    string
+	PeerKey string
+
+	opts Options
+
+	/* Time of last authenticated packet, unix nanos */
+	lastRecv int64
+
+	send sendState
+	recv recvState
+}
+
+/**
+ * Encrypt packet to peer
+ */
+func (this *Session) Seal(plaintext []byte) []byte {
+	return this.send.seal(this.RemoteIndex, plaintext, this.opts)
+}
+
+/**
+ * Authenticate, check for replay and decrypt transport message from peer
+ */
+func (this *Session) Open(packet []byte) ([]byte, error) {
+	if len(packet) < OVERHEAD || packet[0] != TYPE_TRANSPORT {
+		return nil, ErrShortMessage
+	}
+
+	plaintext, err := this.recv.open(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.StoreInt64(&this.lastRecv, time.Now().UnixNano())
+	return plaintext, nil
+}
+
+/**
+ * Check if session received nothing for timeout
+ */
+func (this *Session) idle(timeout time.Duration) bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&this.lastRecv))) > timeout
+}
+
+/**
+ * Sending direction state
+ */
+type sendState struct {
+	sync.Mutex
+
+	key     [32]byte
+	cipher  noise.Cipher
+	phase   byte
+	counter uint64
+	bytes   uint64
+	since   time.Time
+}
+
+func (this *sendState) init(key [32]byte) {
+	this.key = key
+	this.cipher = cipherSuite.Cipher(key)
+	this.since = time.Now()
+}
+
+func (this *sendState) seal(index uint32, plaintext []byte, opts Options) []byte {
+	this.Lock()
+	if this.bytes >= opts.RekeyAfterBytes || time.Since(this.since) >= opts.RekeyAfterTime {
+		this.init(rekey(this.key))
+		this.phase ^= 1
+		this.counter = 0
+		this.bytes = 0
+	}
+	this.counter++
+	this.bytes += uint64(len(plaintext))
+	cipher, phase, counter := this.cipher, this.phase, this.counter
+	this.Unlock()
+
+	packet := make([]byte, TRANSPORT_HEADER_LEN, OVERHEAD+len(plaintext))
+	packet[0] = TYPE_TRANSPORT
+	binary.BigEndian.PutUint32(packet[1:5], index)
+	packet[5] = phase
+	binary.BigEndian.PutUint64(packet[6:14], counter)
+
+	return cipher.Encrypt(packet, counter, packet[:TRANSPORT_HEADER_LEN], plaintext)
+}
+
+/**
+ * Receiving key of one phase
+ */
+type recvKey struct {
+	key    [32]byte
+	cipher noise.Cipher
+	replay *window.Window
+}
+
+func newRecvKey(key [32]byte, replayWindow int) *recvKey {
+	return &recvKey{
+		key:    key,
+		cipher: cipherSuite.Cipher(key),
+		replay: window.New(replayWindow),
+	}
+}
+
+/**
+ * Receiving direction state, keeps previous key for late packets
+ */
+type recvState struct {
+	sync.Mutex
+
+	phase        byte
+	current      *recvKey
+	previous     *recvKey
+	replayWindow int
+
+	/* Key of next phase, derived once per phase */
+	next *recvKey
+
+	failures uint64
+}
+
+func (this *recvState) init(key [32]byte, replayWindow int) {
+	this.replayWindow = replayWindow
+	this.current = newRecvKey(key, replayWindow)
+}
+
+func (this *recvState) open(packet []byte) ([]byte, error) {
+	phase := packet[5]
+	counter := binary.BigEndian.Uint64(packet[6:14])
+	header := packet[:TRANSPORT_HEADER_LEN]
+	ciphertext := packet[TRANSPORT_HEADER_LEN:]
+
+	this.Lock()
+	current, previous, currentPhase := this.current, this.previous, this.phase
+	var next *recvKey
+	if phase != currentPhase {
+		// packets with other phase don't derive key every time
+		if this.next == nil {
+			this.next = newRecvKey(rekey(current.key), this.replayWindow)
+		}
+		next = this.next
+	}
+	this.Unlock()
+
+	var key *recvKey
+	var plaintext []byte
+	var err error
+
+	if phase == currentPhase {
+		key = current
+		plaintext, err = key.cipher.Decrypt(nil, counter, header, ciphertext)
+	} else {
+		// peer rotated its key, or late packet of previous phase
+		plaintext, err = next.cipher.Decrypt(nil, counter, header, ciphertext)
+		if err == nil {
+			this.Lock()
+			if this.current == current {
+				this.previous = current
+				this.current = next
+				this.next = nil
+				this.phase = phase
+			}
+			key = this.current
+			this.Unlock()
+		} else if previous != nil {
+			key = previous
+			plaintext, err = key.cipher.Decrypt(nil, counter, header, ciphertext)
+		}
+	}
+
+	if err != nil {
+		atomic.AddUint64(&this.failures, 1)
+		return nil, ErrAuth
+	}
+
+	if !key.replay.Accept(counter) {
+		return nil, ErrReplay
+	}
+
+	return plaintext, nil
+}
+
+/**
+ * Count of failed authentications of session
+ */
+func (this *Session) AuthFailures() uint64 {
+	return atomic.LoadUint64(&this.recv.failures)
+}
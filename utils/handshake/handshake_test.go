@@ -0,0 +1,276 @@
+package handshake
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+)
+
+/**
+ * Client side of handshake and transport
+ */
+type testInitiator struct {
+	t      *testing.T
+	static noise.DHKey
+	index  uint32
+
+	remoteIndex uint32
+	send        [32]byte
+	recv        [32]byte
+	phase       byte
+	counter     uint64
+}
+
+func newTestKey(t *testing.T) noise.DHKey {
+	key, err := cipherSuite.GenerateKeypair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newTestResponder(t *testing.T, clients ...noise.DHKey) (*Responder, noise.DHKey) {
+	static := newTestKey(t)
+	authorized := map[string]string{}
+	for _, c := range clients {
+		authorized[string(c.Public)] = "client"
+	}
+	return NewResponder(static, authorized, Options{ReplayWindow: 64}), static
+}
+
+/**
+ * Initiation message with payload, keeps handshake state for response
+ */
+func (this *testInitiator) initiation(server noise.DHKey, payload []byte) ([]byte, *noise.HandshakeState) {
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:   cipherSuite,
+		Random:        rand.Reader,
+		Pattern:       noise.HandshakeIK,
+		Initiator:     true,
+		StaticKeypair: this.static,
+		PeerStatic:    server.Public,
+	})
+	if err != nil {
+		this.t.Fatal(err)
+	}
+
+	message := make([]byte, INITIATION_HEADER_LEN)
+	message[0] = TYPE_INITIATION
+	binary.BigEndian.PutUint32(message[1:5], this.index)
+
+	message, _, _, err = hs.WriteMessage(message, payload)
+	if err != nil {
+		this.t.Fatal(err)
+	}
+	return message, hs
+}
+
+func (this *testInitiator) handshake(r *Responder, server noise.DHKey) *Session {
+	message, hs := this.initiation(server, Timestamp(time.Now()))
+
+	response, session, err := r.Handshake(message)
+	if err != nil {
+		this.t.Fatal(err)
+	}
+	if response[0] != TYPE_RESPONSE || binary.BigEndian.Uint32(response[5:9]) != this.index {
+		this.t.Fatalf("bad response header %x", response[:RESPONSE_HEADER_LEN])
+	}
+
+	_, send, recv, err := hs.ReadMessage(nil, response[RESPONSE_HEADER_LEN:])
+	if err != nil {
+		this.t.Fatal(err)
+	}
+
+	this.remoteIndex = binary.BigEndian.Uint32(response[1:5])
+	this.send, this.recv = send.UnsafeKey(), recv.UnsafeKey()
+	this.phase, this.counter = 0, 0
+
+	return session
+}
+
+/**
+ * Transport message with given key phase and counter
+ */
+func (this *testInitiator) transport(key [32]byte, phase byte, counter uint64, plaintext []byte) []byte {
+	packet := make([]byte, TRANSPORT_HEADER_LEN)
+	packet[0] = TYPE_TRANSPORT
+	binary.BigEndian.PutUint32(packet[1:5], this.remoteIndex)
+	packet[5] = phase
+	binary.BigEndian.PutUint64(packet[6:14], counter)
+	return cipherSuite.Cipher(key).Encrypt(packet, counter, packet, plaintext)
+}
+
+func (this *testInitiator) seal(plaintext []byte) []byte {
+	this.counter++
+	return this.transport(this.send, this.phase, this.counter, plaintext)
+}
+
+func (this *testInitiator) open(packet []byte) ([]byte, error) {
+	header := packet[:TRANSPORT_HEADER_LEN]
+	key := this.recv
+	for phase := byte(0); phase != header[5]; phase ^= 1 {
+		key = rekey(key)
+	}
+	return cipherSuite.Cipher(key).Decrypt(nil, binary.BigEndian.Uint64(header[6:14]), header, packet[TRANSPORT_HEADER_LEN:])
+}
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	client := &testInitiator{t: t, static: newTestKey(t), index: 7}
+	r, server := newTestResponder(t, client.static)
+
+	session := client.handshake(r, server)
+	if session.Peer != "client" || session.PeerKey != string(client.static.Public) || session.RemoteIndex != 7 {
+		t.Fatalf("session %+v", session)
+	}
+
+	opened, plaintext, err := r.Open(client.seal([]byte("ping")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened != session || string(plaintext) != "ping" {
+		t.Fatalf("opened %q of %p", plaintext, opened)
+	}
+
+	reply := session.Seal([]byte("pong"))
+	if binary.BigEndian.Uint32(reply[1:5]) != client.index {
+		t.Fatalf("reply to index %d", binary.BigEndian.Uint32(reply[1:5]))
+	}
+	if plaintext, err := client.open(reply); err != nil || string(plaintext) != "pong" {
+		t.Fatalf("client opened %q: %v", plaintext, err)
+	}
+}
+
+func TestTransportReplay(t *testing.T) {
+	client := &testInitiator{t: t, static: newTestKey(t), index: 7}
+	r, server := newTestResponder(t, client.static)
+	session := client.handshake(r, server)
+
+	packet := client.seal([]byte("ping"))
+	if _, _, err := r.Open(packet); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.Open(packet); err != ErrReplay {
+		t.Fatalf("replay: %v", err)
+	}
+
+	tampered := client.seal([]byte("ping"))
+	tampered[len(tampered)-1] ^= 1
+	if _, _, err := r.Open(tampered); err != ErrAuth {
+		t.Fatalf("tampered: %v", err)
+	}
+	if session.AuthFailures() != 1 {
+		t.Fatalf("auth failures %d", session.AuthFailures())
+	}
+}
+
+func TestInitiationReplay(t *testing.T) {
+	client := &testInitiator{t: t, static: newTestKey(t), index: 7}
+	r, server := newTestResponder(t, client.static)
+
+	now := time.Now()
+	message, _ := client.initiation(server, Timestamp(now))
+	if _, _, err := r.Handshake(message); err != nil {
+		t.Fatal(err)
+	}
+
+	// captured initiation and older ones are rejected
+	if _, _, err := r.Handshake(message); err != ErrOldInitiation {
+		t.Fatalf("replayed initiation: %v", err)
+	}
+	older, _ := client.initiation(server, Timestamp(now.Add(-time.Second)))
+	if _, _, err := r.Handshake(older); err != ErrOldInitiation {
+		t.Fatalf("older initiation: %v", err)
+	}
+
+	missing, _ := client.initiation(server, nil)
+	if _, _, err := r.Handshake(missing); err != ErrBadTimestamp {
+		t.Fatalf("initiation without timestamp: %v", err)
+	}
+
+	stranger := &testInitiator{t: t, static: newTestKey(t), index: 8}
+	unauthorized, _ := stranger.initiation(server, Timestamp(now))
+	if _, _, err := r.Handshake(unauthorized); err != ErrUnauthorized {
+		t.Fatalf("unauthorized: %v", err)
+	}
+}
+
+func TestRehandshakeReplacesSession(t *testing.T) {
+	client := &testInitiator{t: t, static: newTestKey(t), index: 7}
+	r, server := newTestResponder(t, client.static)
+
+	client.handshake(r, server)
+	old := client.seal([]byte("ping"))
+
+	time.Sleep(time.Millisecond)
+	session := client.handshake(r, server)
+
+	if _, _, err := r.Open(old); err != ErrUnknownSession {
+		t.Fatalf("packet of replaced session: %v", err)
+	}
+	if opened, _, err := r.Open(client.seal([]byte("ping"))); err != nil || opened != session {
+		t.Fatalf("packet of new session: %v", err)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	client := &testInitiator{t: t, static: newTestKey(t), index: 7}
+	r, server := newTestResponder(t, client.static)
+	session := client.handshake(r, server)
+
+	late := client.seal([]byte("late"))
+
+	// junk with other phase derives next key once
+	junk := client.transport([32]byte{}, 1, 100, []byte("junk"))
+	for i := 0; i < 2; i++ {
+		if _, _, err := r.Open(junk); err != ErrAuth {
+			t.Fatalf("junk: %v", err)
+		}
+	}
+	next := session.recv.next
+	if next == nil {
+		t.Fatal("next key is not cached")
+	}
+	if _, _, err := r.Open(junk); err != ErrAuth || session.recv.next != next {
+		t.Fatalf("next key derived again: %v", err)
+	}
+
+	// client rotates its key
+	client.send = rekey(client.send)
+	client.phase = 1
+	client.counter = 0
+	if _, plaintext, err := r.Open(client.seal([]byte("rekeyed"))); err != nil || string(plaintext) != "rekeyed" {
+		t.Fatalf("rekeyed packet %q: %v", plaintext, err)
+	}
+	if session.recv.phase != 1 || session.recv.next != nil {
+		t.Fatal("receiver did not switch phase")
+	}
+
+	// late packet of previous phase is still accepted once
+	if _, plaintext, err := r.Open(late); err != nil || string(plaintext) != "late" {
+		t.Fatalf("late packet %q: %v", plaintext, err)
+	}
+	if _, _, err := r.Open(late); err != ErrReplay {
+		t.Fatalf("replayed late packet: %v", err)
+	}
+}
+
+func TestSendRekey(t *testing.T) {
+	client := &testInitiator{t: t, static: newTestKey(t), index: 7}
+	static := newTestKey(t)
+	r := NewResponder(static, map[string]string{string(client.static.Public): "client"}, Options{RekeyAfterBytes: 8})
+	session := client.handshake(r, static)
+
+	first := session.Seal([]byte("01234567"))
+	second := session.Seal([]byte("01234567"))
+	if first[5] != 0 || second[5] != 1 || binary.BigEndian.Uint64(second[6:14]) != 1 {
+		t.Fatalf("phases %d %d", first[5], second[5])
+	}
+	for _, packet := range [][]byte{first, second} {
+		if _, err := client.open(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+/**
+ * keys.go - static keys and authorized keys loading
+ */
+package handshake
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/flynn/noise"
+	"golang.org/x/crypto/curve25519"
+)
+
+const KEY_LEN = 32
+
+/**
+ * Decode base64 encoded curve25519 key
+ */
+func DecodeKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != KEY_LEN {
+		return nil, errors.New("Bad key length")
+	}
+	return key, nil
+}
+
+/**
+ * Load static keypair from base64 private key, or from file if key is empty
+ */
+func LoadPrivateKey(key string, keyFile string) (noise.DHKey, error) {
+
+	if key == "" && keyFile != "" {
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return noise.DHKey{}, err
+		}
+		key = string(data)
+	}
+
+	private, err := DecodeKey(key)
+	if err != nil {
+		return noise.DHKey{}, err
+	}
+
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return noise.DHKey{}, err
+	}
+
+	return noise.DHKey{Private: private, Public: public}, nil
+}
+
+/**
+ * Load authorized keys file
+ * Each line is base64 public key with optional name, # starts comment
+ * Returns names by raw public keys
+ */
+func LoadAuthorizedKeys(path string) (map[string]string, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		key, err := DecodeKey(fields[0])
+		if err != nil {
+			return nil, errors.New("Bad authorized key " + fields[0] + ": " + err.Error())
+		}
+
+		name := fields[0]
+		if len(fields) > 1 {
+			name = strings.Join(fields[1:], " ")
+		}
+		keys[string(key)] = name
+	}
+
+	return keys, scanner.Err()
+}
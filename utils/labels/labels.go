@@ -0,0 +1,193 @@
+/**
+ * labels.go - backend labels and label selectors
+ */
+package labels
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/**
+ * Label selector operators
+ */
+const (
+	OP_EQUAL = iota
+	OP_NOT_EQUAL
+	OP_EXISTS
+	OP_NOT_EXISTS
+)
+
+/**
+ * Valid label key and value
+ */
+var (
+	keyPattern   = regexp.MustCompile(`^[A-Za-z0-9_./-]+$`)
+	valuePattern = regexp.MustCompile(`^[A-Za-z0-9_./:-]*$`)
+)
+
+/**
+ * Single requirement of selector
+ */
+type requirement struct {
+	key   string
+	op    int
+	value string
+}
+
+/**
+ * Label selector, all requirements should match.
+ * Nil selector matches everything
+ */
+type Selector struct {
+	requirements []requirement
+	source       string
+}
+
+/**
+ * Parse comma separated selector, requirements are
+ * `key=value`, `key!=value`, `key` and `!key`
+ */
+func ParseSelector(s string) (*Selector, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+
+	selector := &Selector{source: s}
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+
+		r := requirement{op: OP_EXISTS, key: part}
+		switch {
+		case strings.Contains(part, "!="):
+			kv := strings.SplitN(part, "!=", 2)
+			r = requirement{op: OP_NOT_EQUAL, key: kv[0], value: kv[1]}
+		case strings.Contains(part, "="):
+			kv := strings.SplitN(part, "=", 2)
+			r = requirement{op: OP_EQUAL, key: kv[0], value: kv[1]}
+		case strings.HasPrefix(part, "!"):
+			r = requirement{op: OP_NOT_EXISTS, key: part[1:]}
+		}
+
+		r.key = strings.TrimSpace(r.key)
+		r.value = strings.TrimSpace(r.value)
+		if !ValidKey(r.key) || !ValidValue(r.value) {
+			return nil, errors.New("Bad label selector requirement '" + part + "'")
+		}
+
+		selector.requirements = append(selector.requirements, r)
+	}
+
+	return selector, nil
+}
+
+/**
+ * Check if labels satisfy selector
+ */
+func (this *Selector) Matches(labels map[string]string) bool {
+	if this == nil {
+		return true
+	}
+
+	for _, r := range this.requirements {
+		value, ok := labels[r.key]
+		switch r.op {
+		case OP_EQUAL:
+			if !ok || value != r.value {
+				return false
+			}
+		case OP_NOT_EQUAL:
+			if ok && value == r.value {
+				return false
+			}
+		case OP_EXISTS:
+			if !ok {
+				return false
+			}
+		case OP_NOT_EXISTS:
+			if ok {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+/**
+ * String conversion
+ */
+func (this *Selector) String() string {
+	if this == nil {
+		return ""
+	}
+	return this.source
+}
+
+/**
+ * Check if string could be used as label key
+ */
+func ValidKey(key string) bool {
+	return keyPattern.MatchString(key)
+}
+
+/**
+ * Check if string could be used as label value
+ */
+func ValidValue(value string) bool {
+	return valuePattern.MatchString(value)
+}
+
+/**
+ * Split labels into valid ones and invalid `key=value` pairs.
+ * Returns nil map if there are no valid labels
+ */
+func Validate(labels map[string]string) (map[string]string, []string) {
+	var valid map[string]string
+	var invalid []string
+	for k, v := range labels {
+		if !ValidKey(k) || !ValidValue(v) {
+			invalid = append(invalid, k+"="+v)
+			continue
+		}
+		if valid == nil {
+			valid = make(map[string]string)
+		}
+		valid[k] = v
+	}
+	sort.Strings(invalid)
+	return valid, invalid
+}
+
+/**
+ * Merge labels into new map, later maps override earlier ones.
+ * Returns nil if there are no labels
+ */
+func Merge(maps ...map[string]string) map[string]string {
+	var result map[string]string
+	for _, m := range maps {
+		for k, v := range m {
+			if result == nil {
+				result = make(map[string]string)
+			}
+			result[k] = v
+		}
+	}
+	return result
+}
+
+/**
+ * Format labels as sorted `key=value` list
+ */
+func Format(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
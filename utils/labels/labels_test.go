@@ -0,0 +1,27 @@
+package labels
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	valid, invalid := Validate(map[string]string{
+		"zone":        "us-east-1a",
+		"app.io/name": "tun",
+		"bad key":     "x",
+		"team":        "a b",
+		"url":         "http://x",
+		"":            "empty",
+	})
+	if !reflect.DeepEqual(valid, map[string]string{"zone": "us-east-1a", "app.io/name": "tun", "url": "http://x"}) {
+		t.Fatalf("valid %v", valid)
+	}
+	if !reflect.DeepEqual(invalid, []string{"=empty", "bad key=x", "team=a b"}) {
+		t.Fatalf("invalid %v", invalid)
+	}
+
+	if valid, _ := Validate(map[string]string{"bad key": "x"}); valid != nil {
+		t.Fatalf("valid %v without valid labels", valid)
+	}
+}
@@ -0,0 +1,97 @@
+/**
+ * mss.go - TCP MSS clamping for tunneled IPv4 packets
+ */
+package mss
+
+import (
+	"encoding/binary"
+
+	"../packet"
+)
+
+const (
+	IPV4_HEADER_LEN = 20
+	UDP_HEADER_LEN  = 8
+	TCP_HEADER_LEN  = 20
+
+	TCP_FLAG_SYN    = 0x02
+	TCP_OPT_END     = 0
+	TCP_OPT_NOP     = 1
+	TCP_OPT_MSS     = 2
+	TCP_OPT_MSS_LEN = 4
+)
+
+/**
+ * Max segment size of inner TCP that fits into given mtu
+ */
+func ForMtu(mtu int) int {
+	return mtu - IPV4_HEADER_LEN - TCP_HEADER_LEN
+}
+
+/**
+ * Rewrite MSS option of IPv4 TCP SYN (and SYN-ACK) packet
+ * in place if it's greater than mss, fixing TCP checksum.
+ * Returns true if packet was changed
+ */
+func Clamp(buf []byte, mss int) bool {
+
+	if mss <= 0 || len(buf) < IPV4_HEADER_LEN || buf[0]>>4 != 4 {
+		return false
+	}
+
+	ihl := int(buf[0]&0x0f) * 4
+	totalLen := int(binary.BigEndian.Uint16(buf[2:4]))
+	if ihl < IPV4_HEADER_LEN || totalLen > len(buf) || totalLen < ihl+TCP_HEADER_LEN {
+		return false
+	}
+
+	// not tcp or not the first fragment
+	if buf[9] != 6 || binary.BigEndian.Uint16(buf[6:8])&0x1fff != 0 {
+		return false
+	}
+
+	tcp := buf[ihl:totalLen]
+	if tcp[13]&TCP_FLAG_SYN == 0 {
+		return false
+	}
+
+	dataOffset := int(tcp[12]>>4) * 4
+	if dataOffset < TCP_HEADER_LEN || dataOffset > len(tcp) {
+		return false
+	}
+
+	options := tcp[TCP_HEADER_LEN:dataOffset]
+	for i := 0; i < len(options); {
+		kind := options[i]
+		if kind == TCP_OPT_END {
+			return false
+		}
+		if kind == TCP_OPT_NOP {
+			i++
+			continue
+		}
+		if i+1 >= len(options) {
+			return false
+		}
+		length := int(options[i+1])
+		if length < 2 || i+length > len(options) {
+			return false
+		}
+		if kind != TCP_OPT_MSS || length != TCP_OPT_MSS_LEN {
+			i += length
+			continue
+		}
+
+		current := binary.BigEndian.Uint16(options[i+2 : i+4])
+		if int(current) <= mss {
+			return false
+		}
+
+		binary.BigEndian.PutUint16(options[i+2:i+4], uint16(mss))
+		checksum := binary.BigEndian.Uint16(tcp[16:18])
+		binary.BigEndian.PutUint16(tcp[16:18], packet.UpdateChecksum(checksum, current, uint16(mss)))
+		return true
+	}
+
+	return false
+}
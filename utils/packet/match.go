@@ -0,0 +1,67 @@
+/**
+ * match.go - inner IPv4 packet classifier shared by acl, routes and duplication
+ */
+package packet
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+/**
+ * Packet classifier, nil and -1 fields match anything
+ */
+type Matcher struct {
+	Src      *net.IPNet
+	Dst      *net.IPNet
+	Dscp     map[int]bool
+	Protocol int
+	Ports    map[int]bool
+
+	/* Match destination port only, otherwise source or destination */
+	DstPortOnly bool
+}
+
+/**
+ * Set of values, nil if there are none
+ */
+func IntSet(values []int) map[int]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	set := make(map[int]bool)
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+/**
+ * Check if packet matches. Ports of tcp/udp non-first fragment or
+ * truncated header are unknown, such packet matches if unknownPorts
+ */
+func (m *Matcher) Match(header *ipv4.Header, buf []byte, unknownPorts bool) bool {
+	if m.Src != nil && !m.Src.Contains(header.Src) {
+		return false
+	}
+	if m.Dst != nil && !m.Dst.Contains(header.Dst) {
+		return false
+	}
+	if m.Dscp != nil && !m.Dscp[Dscp(header.TOS)] {
+		return false
+	}
+	if m.Protocol != -1 && header.Protocol != m.Protocol {
+		return false
+	}
+	if m.Ports != nil {
+		src, dst, ok := Ports(buf)
+		if !ok {
+			return unknownPorts && (header.Protocol == PROTO_TCP || header.Protocol == PROTO_UDP)
+		}
+		if !m.Ports[dst] && (m.DstPortOnly || !m.Ports[src]) {
+			return false
+		}
+	}
+	return true
+}
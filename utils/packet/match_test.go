@@ -0,0 +1,82 @@
+package packet
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"golang.org/x/net/ipv4"
+)
+
+/**
+ * Parsed header and buffer of udp/tcp packet
+ */
+func testPacket(t *testing.T, protocol int, tos int, srcPort int, dstPort int, fragOff int) (*ipv4.Header, []byte) {
+	h := &ipv4.Header{
+		Version:  4,
+		Len:      ipv4.HeaderLen,
+		TOS:      tos,
+		TotalLen: ipv4.HeaderLen + 8,
+		FragOff:  fragOff,
+		TTL:      64,
+		Protocol: protocol,
+		Src:      net.ParseIP("192.168.0.1"),
+		Dst:      net.ParseIP("10.0.0.1"),
+	}
+	buf, err := h.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ports := make([]byte, 8)
+	binary.BigEndian.PutUint16(ports[0:2], uint16(srcPort))
+	binary.BigEndian.PutUint16(ports[2:4], uint16(dstPort))
+	buf = append(buf, ports...)
+
+	header, err := ipv4.ParseHeader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header, buf
+}
+
+func TestMatcher(t *testing.T) {
+	_, inside, _ := net.ParseCIDR("10.0.0.0/8")
+	_, outside, _ := net.ParseCIDR("172.16.0.0/12")
+
+	cases := []struct {
+		name     string
+		matcher  Matcher
+		protocol int
+		tos      int
+		srcPort  int
+		dstPort  int
+		fragOff  int
+		unknown  bool
+		expected bool
+	}{
+		{"any", Matcher{Protocol: -1}, PROTO_UDP, 0, 1000, 53, 0, false, true},
+		{"dst", Matcher{Protocol: -1, Dst: inside}, PROTO_UDP, 0, 1000, 53, 0, false, true},
+		{"other dst", Matcher{Protocol: -1, Dst: outside}, PROTO_UDP, 0, 1000, 53, 0, false, false},
+		{"src", Matcher{Protocol: -1, Src: inside}, PROTO_UDP, 0, 1000, 53, 0, false, false},
+		{"dscp", Matcher{Protocol: -1, Dscp: IntSet([]int{46})}, PROTO_UDP, 46 << 2, 1000, 53, 0, false, true},
+		{"other dscp", Matcher{Protocol: -1, Dscp: IntSet([]int{46})}, PROTO_UDP, 0, 1000, 53, 0, false, false},
+		{"protocol", Matcher{Protocol: PROTO_TCP}, PROTO_UDP, 0, 1000, 53, 0, false, false},
+		{"dst port", Matcher{Protocol: -1, Ports: IntSet([]int{53})}, PROTO_UDP, 0, 1000, 53, 0, false, true},
+		{"src port", Matcher{Protocol: -1, Ports: IntSet([]int{53})}, PROTO_UDP, 0, 53, 1000, 0, false, true},
+		{"src port of dst only", Matcher{Protocol: -1, Ports: IntSet([]int{53}), DstPortOnly: true}, PROTO_UDP, 0, 53, 1000, 0, false, false},
+		{"fragment", Matcher{Protocol: -1, Ports: IntSet([]int{53})}, PROTO_UDP, 0, 1000, 53, 1, false, false},
+		{"fragment with unknown ports", Matcher{Protocol: -1, Ports: IntSet([]int{53})}, PROTO_UDP, 0, 1000, 53, 1, true, true},
+		{"icmp with unknown ports", Matcher{Protocol: -1, Ports: IntSet([]int{53})}, PROTO_ICMP, 0, 1000, 53, 0, true, false},
+	}
+
+	for _, c := range cases {
+		header, buf := testPacket(t, c.protocol, c.tos, c.srcPort, c.dstPort, c.fragOff)
+		if result := c.matcher.Match(header, buf, c.unknown); result != c.expected {
+			t.Errorf("%s: match %v, expected %v", c.name, result, c.expected)
+		}
+	}
+
+	if IntSet(nil) != nil {
+		t.Fatal("empty set is not nil")
+	}
+}
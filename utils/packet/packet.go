@@ -0,0 +1,79 @@
+/**
+ * packet.go - inner IPv4 packet helpers
+ */
+package packet
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+const (
+	PROTO_ICMP = 1
+	PROTO_TCP  = 6
+	PROTO_UDP  = 17
+)
+
+/**
+ * Protocol number by name, or -1 if unknown
+ */
+func Protocol(name string) int {
+	switch strings.ToLower(name) {
+	case "icmp":
+		return PROTO_ICMP
+	case "tcp":
+		return PROTO_TCP
+	case "udp":
+		return PROTO_UDP
+	default:
+		return -1
+	}
+}
+
+/**
+ * DSCP from TOS byte
+ */
+func Dscp(tos int) int {
+	return tos >> 2
+}
+
+/**
+ * Source and destination ports of TCP/UDP IPv4 packet
+ */
+func Ports(packet []byte) (int, int, bool) {
+
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return 0, 0, false
+	}
+
+	proto := packet[9]
+	if proto != PROTO_TCP && proto != PROTO_UDP {
+		return 0, 0, false
+	}
+
+	// not the first fragment
+	if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+		return 0, 0, false
+	}
+
+	ihl := int(packet[0]&0x0f) * 4
+	if ihl < 20 || len(packet) < ihl+4 {
+		return 0, 0, false
+	}
+
+	src := int(binary.BigEndian.Uint16(packet[ihl : ihl+2]))
+	dst := int(binary.BigEndian.Uint16(packet[ihl+2 : ihl+4]))
+
+	return src, dst, true
+}
+
+/**
+ * Incremental checksum update, RFC 1624
+ */
+func UpdateChecksum(checksum, old, new uint16) uint16 {
+	sum := uint32(^checksum) + uint32(^old) + uint32(new)
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
@@ -9,15 +9,34 @@ package parsers
 
 import (
 	"../../core"
+	"../labels"
+	"../ratelimit"
 	"errors"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
 const (
-	DEFAULT_BACKEND_PATTERN = `^(?P<host>\S+):(?P<port>\d+)(\sweight=(?P<weight>\d+))?(\spriority=(?P<priority>\d+))?(\ssni=(?P<sni>[^\s]+))?$`
+	DEFAULT_BACKEND_PATTERN = `^(?P<host>\S+):(?P<port>\d+)(?P<options>(\s+\S+=\S*)*)\s*$`
 )
 
+/**
+ * Known backend options, other options of backend line are labels
+ */
+var backendOptions = map[string]bool{
+	"weight":    true,
+	"priority":  true,
+	"sni":       true,
+	"mtu":       true,
+	"key":       true,
+	"rate":      true,
+	"dscp":      true,
+	"source":    true,
+	"interface": true,
+	"mark":      true,
+}
+
 /**
  * Do parding of backend line with default pattern
  */
@@ -49,25 +68,112 @@ func ParseBackend(line string, pattern string) (*core.Backend, error) {
 			result[name] = match[i]
 		}
 	}
-	/*
 
-	weight, err := strconv.Atoi(result["weight"])
+	// options are `key=value` pairs in any order
+	backendLabels := make(map[string]string)
+	for _, option := range strings.Fields(result["options"]) {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Bad option " + option + " in " + line)
+		}
+		if backendOptions[kv[0]] {
+			if result[kv[0]] == "" {
+				result[kv[0]] = kv[1]
+			}
+			continue
+		}
+		if !labels.ValidKey(kv[0]) {
+			return nil, errors.New("Bad option " + option + " in " + line)
+		}
+		if !labels.ValidValue(kv[1]) {
+			return nil, errors.New("Bad label " + option + " in " + line)
+		}
+		backendLabels[kv[0]] = kv[1]
+	}
+
+	// labels group of custom patterns, `key=value` separated by spaces or commas
+	for _, label := range strings.FieldsFunc(result["labels"], func(r rune) bool { return r == ',' || r == ' ' }) {
+		kv := strings.SplitN(label, "=", 2)
+		if len(kv) != 2 || !labels.ValidKey(kv[0]) || !labels.ValidValue(kv[1]) {
+			return nil, errors.New("Bad label " + label + " in " + line)
+		}
+		backendLabels[kv[0]] = kv[1]
+	}
+	if len(backendLabels) == 0 {
+		backendLabels = nil
+	}
+
+	weight, err := parseIntOr(result["weight"], 1)
+	if err != nil {
+		return nil, errors.New("Bad weight value in " + line)
+	}
+
+	priority, err := parseIntOr(result["priority"], 1)
 	if err != nil {
-		weight = 1
+		return nil, errors.New("Bad priority value in " + line)
 	}
 
-	priority, err := strconv.Atoi(result["priority"])
+	mtu, err := parseIntOr(result["mtu"], 0)
 	if err != nil {
-		priority = 1
+		return nil, errors.New("Bad mtu value in " + line)
+	}
+
+	rate := 0.0
+	if result["rate"] != "" {
+		rate, err = ratelimit.ParseRate(result["rate"])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if result["dscp"] != "" && result["dscp"] != "copy" {
+		dscp, err := strconv.Atoi(result["dscp"])
+		if err != nil || dscp < 0 || dscp > 63 {
+			return nil, errors.New("Bad dscp value in " + line)
+		}
+	}
+
+	mark := 0
+	if result["mark"] != "" {
+		m, err := strconv.ParseUint(result["mark"], 0, 32)
+		if err != nil {
+			return nil, errors.New("Bad mark value in " + line)
+		}
+		mark = int(m)
+	}
+
+	// IPv6 host is bracketed in line, target keeps bare address
+	host := result["host"]
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
 	}
-	*/
 
 	backend := core.Backend{
 		Target: core.Target{
-			Host: result["host"],
-			Port: result["port"],
+			Host:      host,
+			Port:      result["port"],
+			Source:    result["source"],
+			Interface: result["interface"],
+			Mark:      mark,
 		},
+		Priority: priority,
+		Weight:   weight,
+		Mtu:      mtu,
+		Key:      result["key"],
+		Rate:     rate,
+		Dscp:     result["dscp"],
+		Labels:   backendLabels,
 	}
 
 	return &backend, nil
 }
+
+/**
+ * Parse integer, empty string is default value
+ */
+func parseIntOr(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	return strconv.Atoi(s)
+}
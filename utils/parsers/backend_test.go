@@ -0,0 +1,52 @@
+package parsers
+
+import (
+	"testing"
+)
+
+func TestParseBackendOptions(t *testing.T) {
+	backend, err := ParseBackendDefault("10.0.0.1:4000 weight=5 priority=2 mtu=1400 zone=a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backend.Target.Address() != "10.0.0.1:4000" || backend.Weight != 5 || backend.Priority != 2 || backend.Mtu != 1400 {
+		t.Fatalf("parsed %+v", backend)
+	}
+	if len(backend.Labels) != 1 || backend.Labels["zone"] != "a" {
+		t.Fatalf("labels %v", backend.Labels)
+	}
+}
+
+func TestParseBackendIPv6(t *testing.T) {
+	backend, err := ParseBackendDefault("[::1]:4000 weight=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backend.Target.Host != "::1" || backend.Target.Port != "4000" || backend.Weight != 2 {
+		t.Fatalf("parsed %+v", backend)
+	}
+	if backend.Target.Address() != "[::1]:4000" {
+		t.Fatalf("address %s", backend.Target.Address())
+	}
+}
+
+func TestParseBackendErrors(t *testing.T) {
+	for _, line := range []string{
+		"10.0.0.1",
+		"10.0.0.1:4000 weight=x",
+		"10.0.0.1:4000 dscp=64",
+		"10.0.0.1:4000 zone=a\"b",
+	} {
+		if _, err := ParseBackendDefault(line); err == nil {
+			t.Fatalf("no error for %q", line)
+		}
+	}
+}
+
+func TestParseBackendOptionWithoutValue(t *testing.T) {
+	// custom pattern capturing option without `=`
+	pattern := `^(?P<host>\S+):(?P<port>\d+)(?P<options>(\s+\S+)*)\s*$`
+	if _, err := ParseBackend("10.0.0.1:4000 weight", pattern); err == nil {
+		t.Fatal("no error for option without value")
+	}
+}
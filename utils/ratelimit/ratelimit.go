@@ -0,0 +1,161 @@
+/**
+ * ratelimit.go - token bucket rate limiter
+ */
+package ratelimit
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Token bucket
+ */
+type Bucket struct {
+	sync.Mutex
+
+	/* Tokens added per second */
+	rate float64
+
+	/* Max tokens in bucket */
+	burst float64
+
+	tokens float64
+	last   time.Time
+}
+
+/**
+ * Creates new full bucket, burst defaults to rate
+ */
+func New(rate float64, burst float64) *Bucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &Bucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+/**
+ * Take one token if available
+ */
+func (this *Bucket) Allow() bool {
+	return this.AllowN(1)
+}
+
+/**
+ * Take n tokens if available
+ */
+func (this *Bucket) AllowN(n float64) bool {
+	this.Lock()
+	defer this.Unlock()
+
+	this.refill(time.Now())
+
+	if this.tokens < n {
+		return false
+	}
+
+	this.tokens -= n
+	return true
+}
+
+/**
+ * Time until n tokens are available, tokens are not taken
+ */
+func (this *Bucket) Wait(n float64) time.Duration {
+	this.Lock()
+	defer this.Unlock()
+
+	this.refill(time.Now())
+
+	if this.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - this.tokens) / this.rate * float64(time.Second))
+}
+
+/**
+ * Take n tokens, going into debt if needed
+ */
+func (this *Bucket) Take(n float64) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.refill(time.Now())
+	this.tokens -= n
+}
+
+/**
+ * Change rate and burst in place, keeping accumulated tokens
+ * up to new burst, burst defaults to rate
+ */
+func (this *Bucket) SetRate(rate float64, burst float64) {
+	this.Lock()
+	defer this.Unlock()
+
+	if burst <= 0 {
+		burst = rate
+	}
+
+	// tokens accumulated so far are counted at old rate
+	this.refill(time.Now())
+	this.rate = rate
+	this.burst = burst
+	if this.tokens > burst {
+		this.tokens = burst
+	}
+}
+
+/**
+ * Parse rate in tc(8) notation to bytes per second
+ * bit, kbit, mbit, gbit are bits per second,
+ * bps, kbps, mbps, gbps and bare number are bytes per second
+ */
+func ParseRate(s string) (float64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	units := []struct {
+		suffix string
+		factor float64
+	}{
+		{"gbit", 1e9 / 8},
+		{"mbit", 1e6 / 8},
+		{"kbit", 1e3 / 8},
+		{"bit", 1.0 / 8},
+		{"gbps", 1e9},
+		{"mbps", 1e6},
+		{"kbps", 1e3},
+		{"bps", 1},
+	}
+
+	factor := 1.0
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			factor = u.factor
+			s = strings.TrimSuffix(s, u.suffix)
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value <= 0 {
+		return 0, errors.New("Bad rate " + s)
+	}
+
+	return value * factor, nil
+}
+
+func (this *Bucket) refill(now time.Time) {
+	this.tokens += now.Sub(this.last).Seconds() * this.rate
+	if this.tokens > this.burst {
+		this.tokens = this.burst
+	}
+	this.last = now
+}
@@ -0,0 +1,259 @@
+/**
+ * reorder.go - receive side reorder buffer keyed by sequence number
+ */
+package reorder
+
+import (
+	"sync"
+	"time"
+)
+
+/**
+ * Sequence number of the first packet of flow
+ */
+const INITIAL_SEQ = 1
+
+/**
+ * Buffered out of order packet
+ */
+type entry struct {
+	packet  []byte
+	arrived time.Time
+}
+
+/**
+ * Reorder buffer
+ * Holds packets arrived ahead of expected sequence number
+ * until gap is filled, buffer is full or timeout is reached
+ */
+type Buffer struct {
+	sync.Mutex
+
+	/* Max packets to hold */
+	size int
+
+	/* Max time to hold packet */
+	timeout time.Duration
+
+	/* Function to deliver ordered packets to */
+	deliver func([]byte)
+
+	/* Next expected sequence number */
+	next    uint32
+	started bool
+
+	/* Packets waiting for gap to be filled */
+	packets map[uint32]entry
+
+	timer   *time.Timer
+	stopped bool
+
+	/* Ordered packets to deliver outside of lock, by one goroutine at time */
+	pending    [][]byte
+	delivering bool
+}
+
+/**
+ * Creates new reorder buffer
+ */
+func New(size int, timeout time.Duration, deliver func([]byte)) *Buffer {
+	return &Buffer{
+		size:    size,
+		timeout: timeout,
+		deliver: deliver,
+		packets: make(map[uint32]entry),
+	}
+}
+
+/**
+ * Push packet with sequence number to buffer
+ * packet is copied if it has to be held
+ */
+func (this *Buffer) Push(seq uint32, packet []byte) {
+	this.Lock()
+	defer this.drain()
+
+	if this.stopped {
+		return
+	}
+
+	// first packet may be reordered too, so other ones are held
+	// until initial one arrives or they are skipped to
+	if !this.started && seq == INITIAL_SEQ {
+		this.started = true
+		this.next = seq
+	}
+
+	// late packet, gap was already skipped
+	if this.started && before(seq, this.next) {
+		this.ready(packet)
+		return
+	}
+
+	if this.started && seq == this.next {
+		this.ready(packet)
+		this.next++
+		this.flush()
+		return
+	}
+
+	if _, ok := this.packets[seq]; ok {
+		return
+	}
+
+	held := make([]byte, len(packet))
+	copy(held, packet)
+	this.packets[seq] = entry{held, time.Now()}
+
+	for len(this.packets) > this.size {
+		this.skip()
+	}
+
+	this.arm()
+}
+
+/**
+ * Stop buffer, dropping held packets
+ */
+func (this *Buffer) Stop() {
+	this.Lock()
+	defer this.Unlock()
+
+	this.stopped = true
+	this.packets = make(map[uint32]entry)
+	this.pending = nil
+	if this.timer != nil {
+		this.timer.Stop()
+	}
+}
+
+/**
+ * Queue packet of caller for delivery, copying it
+ * if other goroutine delivers it after Push returns
+ */
+func (this *Buffer) ready(packet []byte) {
+	if this.delivering {
+		held := make([]byte, len(packet))
+		copy(held, packet)
+		packet = held
+	}
+	this.pending = append(this.pending, packet)
+}
+
+/**
+ * Deliver pending packets without holding lock, called locked and unlocks.
+ * If other goroutine is delivering, it delivers them keeping the order
+ */
+func (this *Buffer) drain() {
+	if this.delivering {
+		this.Unlock()
+		return
+	}
+
+	this.delivering = true
+	for len(this.pending) > 0 {
+		pending := this.pending
+		this.pending = nil
+		this.Unlock()
+		for _, packet := range pending {
+			this.deliver(packet)
+		}
+		this.Lock()
+	}
+	this.delivering = false
+	this.Unlock()
+}
+
+/**
+ * Queue consecutive packets starting at next
+ */
+func (this *Buffer) flush() {
+	for {
+		e, ok := this.packets[this.next]
+		if !ok {
+			return
+		}
+		delete(this.packets, this.next)
+		this.pending = append(this.pending, e.packet)
+		this.next++
+	}
+}
+
+/**
+ * Give up waiting for the gap, jump to the oldest held sequence number
+ */
+func (this *Buffer) skip() {
+	first := true
+	var min uint32
+	for seq := range this.packets {
+		if first || before(seq, min) {
+			min = seq
+			first = false
+		}
+	}
+	if first {
+		return
+	}
+	this.started = true
+	this.next = min
+	this.flush()
+}
+
+/**
+ * Arm timer for the oldest held packet
+ */
+func (this *Buffer) arm() {
+	if len(this.packets) == 0 {
+		return
+	}
+
+	var oldest time.Time
+	for _, e := range this.packets {
+		if oldest.IsZero() || e.arrived.Before(oldest) {
+			oldest = e.arrived
+		}
+	}
+
+	wait := oldest.Add(this.timeout).Sub(time.Now())
+	if this.timer == nil {
+		this.timer = time.AfterFunc(wait, this.expire)
+	} else {
+		this.timer.Reset(wait)
+	}
+}
+
+/**
+ * Timer handler, skips gaps of expired packets
+ */
+func (this *Buffer) expire() {
+	this.Lock()
+	defer this.drain()
+
+	if this.stopped {
+		return
+	}
+
+	deadline := time.Now().Add(-this.timeout)
+	for {
+		expired := false
+		for _, e := range this.packets {
+			if !e.arrived.After(deadline) {
+				expired = true
+				break
+			}
+		}
+		if !expired {
+			break
+		}
+		this.skip()
+	}
+
+	this.arm()
+}
+
+/**
+ * Sequence number comparison with wrap around
+ */
+func before(a, b uint32) bool {
+	return int32(a-b) < 0
+}
@@ -0,0 +1,111 @@
+package reorder
+
+import (
+	"encoding/binary"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+/**
+ * Collects sequence numbers of delivered packets
+ */
+type collector struct {
+	sync.Mutex
+	seqs []uint32
+}
+
+func (this *collector) deliver(packet []byte) {
+	this.Lock()
+	defer this.Unlock()
+	this.seqs = append(this.seqs, binary.BigEndian.Uint32(packet))
+}
+
+func (this *collector) delivered() []uint32 {
+	this.Lock()
+	defer this.Unlock()
+	return append([]uint32{}, this.seqs...)
+}
+
+func seqPacket(seq uint32) []byte {
+	packet := make([]byte, 4)
+	binary.BigEndian.PutUint32(packet, seq)
+	return packet
+}
+
+func TestReorder(t *testing.T) {
+
+	const timeout = 50 * time.Millisecond
+
+	tests := []struct {
+		name string
+		size int
+		/* Pushed sequence numbers, 0 waits for timeout */
+		pushes []int64
+		want   []uint32
+	}{
+		{"in order", 8, []int64{1, 2, 3}, []uint32{1, 2, 3}},
+		{"reordered", 8, []int64{2, 1, 4, 3}, []uint32{1, 2, 3, 4}},
+		{"first packet reordered", 8, []int64{3, 2, 1}, []uint32{1, 2, 3}},
+		{"duplicate held", 8, []int64{1, 3, 3, 2}, []uint32{1, 2, 3}},
+		{"gap skipped on timeout", 8, []int64{1, 3, 4, 0}, []uint32{1, 3, 4}},
+		{"first packet lost", 8, []int64{2, 3, 0}, []uint32{2, 3}},
+		{"late packet", 8, []int64{1, 3, 0, 2, 4}, []uint32{1, 3, 2, 4}},
+		{"gap skipped when full", 2, []int64{1, 3, 4, 5}, []uint32{1, 3, 4, 5}},
+		{"wraparound", 1, []int64{0xfffffffe, 0xffffffff, 1, 0x100000000, 0xfffffffd},
+			[]uint32{0xfffffffe, 0xffffffff, 0, 1, 0xfffffffd}},
+	}
+
+	for _, test := range tests {
+		c := &collector{}
+		b := New(test.size, timeout, c.deliver)
+
+		for _, seq := range test.pushes {
+			if seq == 0 {
+				time.Sleep(3 * timeout)
+				continue
+			}
+			b.Push(uint32(seq), seqPacket(uint32(seq)))
+		}
+		b.Stop()
+
+		if got := c.delivered(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: delivered %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReorderCopiesHeldPackets(t *testing.T) {
+	c := &collector{}
+	b := New(8, time.Second, c.deliver)
+	defer b.Stop()
+
+	packet := seqPacket(2)
+	b.Push(2, packet)
+	// caller reuses its buffer
+	binary.BigEndian.PutUint32(packet, 7)
+	b.Push(1, seqPacket(1))
+
+	if got := c.delivered(); !reflect.DeepEqual(got, []uint32{1, 2}) {
+		t.Fatalf("delivered %v", got)
+	}
+}
+
+func TestReorderDeliversWithoutLock(t *testing.T) {
+	var b *Buffer
+	delivered := 0
+	b = New(8, time.Second, func(packet []byte) {
+		delivered++
+		// pushing from deliver would deadlock if lock was held
+		if delivered == 1 {
+			b.Push(2, seqPacket(2))
+		}
+	})
+	defer b.Stop()
+
+	b.Push(1, seqPacket(1))
+	if delivered != 2 {
+		t.Fatalf("delivered %d packets", delivered)
+	}
+}
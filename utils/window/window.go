@@ -0,0 +1,90 @@
+/**
+ * window.go - sliding window of seen sequence numbers
+ * Used for duplicate detection and anti-replay (RFC 6479 style bitmap)
+ */
+package window
+
+import (
+	"sync"
+)
+
+const WORD_BITS = 64
+
+/**
+ * Sliding window
+ */
+type Window struct {
+	sync.Mutex
+
+	/* Window size in sequence numbers */
+	size uint64
+
+	/* Highest accepted sequence number */
+	top     uint64
+	started bool
+
+	bitmap []uint64
+}
+
+/**
+ * Creates window remembering last size sequence numbers
+ */
+func New(size int) *Window {
+	words := (size + WORD_BITS - 1) / WORD_BITS
+	if words < 1 {
+		words = 1
+	}
+	return &Window{
+		size:   uint64(size),
+		bitmap: make([]uint64, words+1),
+	}
+}
+
+/**
+ * Returns true and marks seq as seen if it's new and not
+ * older than window, false otherwise
+ */
+func (this *Window) Accept(seq uint64) bool {
+	this.Lock()
+	defer this.Unlock()
+
+	if !this.started {
+		this.started = true
+		this.top = seq
+		this.set(seq)
+		return true
+	}
+
+	if seq > this.top {
+		// clear words that slid out
+		current := this.top / WORD_BITS
+		next := seq / WORD_BITS
+		diff := next - current
+		if diff > uint64(len(this.bitmap)) {
+			diff = uint64(len(this.bitmap))
+		}
+		for i := uint64(1); i <= diff; i++ {
+			this.bitmap[(current+i)%uint64(len(this.bitmap))] = 0
+		}
+		this.top = seq
+		this.set(seq)
+		return true
+	}
+
+	if this.top-seq >= this.size {
+		return false
+	}
+
+	word := (seq / WORD_BITS) % uint64(len(this.bitmap))
+	bit := uint64(1) << (seq % WORD_BITS)
+	if this.bitmap[word]&bit != 0 {
+		return false
+	}
+	this.bitmap[word] |= bit
+	return true
+}
+
+func (this *Window) set(seq uint64) {
+	word := (seq / WORD_BITS) % uint64(len(this.bitmap))
+	this.bitmap[word] |= uint64(1) << (seq % WORD_BITS)
+}
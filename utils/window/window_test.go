@@ -0,0 +1,33 @@
+package window
+
+import (
+	"testing"
+)
+
+func TestWindow(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		size   int
+		seqs   []uint64
+		accept []bool
+	}{
+		{"in order", 64, []uint64{1, 2, 3}, []bool{true, true, true}},
+		{"duplicate", 64, []uint64{1, 2, 1, 2}, []bool{true, true, false, false}},
+		{"reordered", 64, []uint64{3, 1, 2, 1}, []bool{true, true, true, false}},
+		{"window edge", 64, []uint64{100, 37, 36}, []bool{true, true, false}},
+		{"edge of larger window", 100, []uint64{1000, 901, 900}, []bool{true, true, false}},
+		{"jump clears bitmap", 64, []uint64{1, 2, 1000, 999, 1000, 937}, []bool{true, true, true, true, false, true}},
+		{"word boundary", 64, []uint64{63, 64, 127, 128, 64, 63}, []bool{true, true, true, true, false, false}},
+		{"first seq zero", 64, []uint64{0, 0, 1}, []bool{true, false, true}},
+	}
+
+	for _, test := range tests {
+		w := New(test.size)
+		for i, seq := range test.seqs {
+			if got := w.Accept(seq); got != test.accept[i] {
+				t.Errorf("%s: accept %d at %d is %v", test.name, seq, i, got)
+			}
+		}
+	}
+}